@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type StatusResponse struct {
+	Repo        string    `json:"repo"`
+	Branch      string    `json:"branch"`
+	Ref         string    `json:"ref"`
+	Environment string    `json:"environment,omitempty"`
+	Host        string    `json:"host,omitempty"`
+	Commit      string    `json:"commit"`
+	LastSync    time.Time `json:"last_sync,omitzero"`
+	LastDeploy  time.Time `json:"last_deploy,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+	Stacks      int       `json:"stacks"`
+	Degraded    string    `json:"state_degraded,omitempty"`
+
+	PendingDeletion *PendingDeletion `json:"pending_deletion,omitempty"`
+}
+
+type TriggerResponse struct {
+	Succeeded []string          `json:"succeeded"`
+	Failed    map[string]string `json:"failed"`
+}
+
+type apiServer struct {
+	config   *sharedConfig
+	state    *State
+	targets  []*deployTarget
+	audit    *auditLog
+	triggers chan<- trigger
+}
+
+// startAPIServer serves the API for the given targets. The local target, which
+// comes first, is the one /api/status and /api/stacks describe.
+func startAPIServer(config *sharedConfig, targets []*deployTarget, audit *auditLog, triggers chan<- trigger) *http.Server {
+	addr := config.get().APIAddr
+	if addr == "" {
+		return nil
+	}
+
+	api := &apiServer{config: config, state: targets[0].state, targets: targets, audit: audit, triggers: triggers}
+	server := &http.Server{Addr: addr, Handler: api.routes()}
+
+	go func() {
+		slog.Info("API listening", "addr", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("API server stopped", "error", err)
+		}
+	}()
+
+	return server
+}
+
+func (s *apiServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", s.requireToken(s.handleStatus))
+	mux.HandleFunc("GET /api/stacks", s.requireToken(s.handleStacks))
+	mux.HandleFunc("GET /api/stacks/{name}", s.requireToken(s.handleStack))
+	mux.HandleFunc("GET /api/targets", s.requireToken(s.handleTargets))
+	mux.HandleFunc("GET /api/history", s.requireToken(s.handleHistory))
+	mux.HandleFunc("GET /api/audit", s.requireToken(s.handleAudit))
+	mux.HandleFunc("GET /metrics", s.requireToken(s.handleMetrics))
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.HandleFunc("POST /api/sync", s.requireTriggerToken(s.handleTrigger(triggerSync)))
+	mux.HandleFunc("POST /api/redeploy", s.requireTriggerToken(s.handleTrigger(triggerRedeployAll)))
+	mux.HandleFunc("POST /api/stacks/{name}/redeploy", s.requireTriggerToken(s.handleTrigger(triggerRedeployStack)))
+	mux.HandleFunc("GET /api/deletions", s.requireToken(s.handleDeletions))
+	mux.HandleFunc("POST /api/deletions/confirm", s.requireTriggerToken(s.handleTrigger(triggerConfirmDelete)))
+	mux.HandleFunc("POST /api/state/clear-degraded", s.requireTriggerToken(s.handleTrigger(triggerClearDegraded)))
+	return mux
+}
+
+// requireTriggerToken guards endpoints that change what is running. Unlike the
+// read-only endpoints they stay disabled until API_TOKEN is configured.
+func (s *apiServer) requireTriggerToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.get().APIToken == "" {
+			writeError(w, http.StatusForbidden, "API_TOKEN must be set to use trigger endpoints")
+			return
+		}
+		s.requireToken(next)(w, r)
+	}
+}
+
+func (s *apiServer) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if expected := s.config.get().APIToken; expected != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	config := s.config.get()
+
+	s.state.mu.RLock()
+	response := StatusResponse{
+		Repo:        config.RepoURL,
+		Branch:      config.Branch,
+		Ref:         config.DeployRef.String(),
+		Environment: config.Environment,
+		Host:        config.HostName,
+		Commit:      s.state.LastCommit,
+		LastSync:    s.state.LastSync,
+		LastDeploy:  s.state.LastDeploy,
+		LastError:   s.state.LastError,
+		Stacks:      len(s.state.DeployedStacks),
+		Degraded:    s.state.Degraded,
+	}
+	s.state.mu.RUnlock()
+	response.PendingDeletion = s.state.pendingDeletion()
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// targetState returns the state of the target named by the target query
+// parameter, the local one by default.
+func (s *apiServer) targetState(w http.ResponseWriter, r *http.Request) (*State, bool) {
+	name := r.URL.Query().Get("target")
+	if name == "" {
+		return s.state, true
+	}
+	for _, t := range s.targets {
+		if t.docker.displayName() == name {
+			return t.state, true
+		}
+	}
+	writeError(w, http.StatusNotFound, "target not found")
+	return nil, false
+}
+
+func (s *apiServer) handleStacks(w http.ResponseWriter, r *http.Request) {
+	state, ok := s.targetState(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, state.stackStatuses())
+}
+
+func (s *apiServer) handleStack(w http.ResponseWriter, r *http.Request) {
+	state, ok := s.targetState(w, r)
+	if !ok {
+		return
+	}
+	status, ok := state.stackStatus(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "stack not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *apiServer) handleDeletions(w http.ResponseWriter, r *http.Request) {
+	state, ok := s.targetState(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, state.pendingDeletion())
+}
+
+func (s *apiServer) handleTargets(w http.ResponseWriter, r *http.Request) {
+	targets := []TargetStatus{}
+	for _, t := range s.targets {
+		targets = append(targets, t.status())
+	}
+	writeJSON(w, http.StatusOK, targets)
+}
+
+func (s *apiServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	state, ok := s.targetState(w, r)
+	if !ok {
+		return
+	}
+
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, state.recentHistory(limit))
+}
+
+func (s *apiServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := AuditFilter{Stack: query.Get("stack")}
+
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		filter.Limit = n
+	}
+
+	var err error
+	if filter.Since, err = parseTimeParam(query.Get("since")); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid since: "+err.Error())
+		return
+	}
+	if filter.Until, err = parseTimeParam(query.Get("until")); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid until: "+err.Error())
+		return
+	}
+
+	records, err := s.audit.query(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// parseTimeParam accepts an RFC 3339 timestamp or a duration such as 24h,
+// meaning that long ago.
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (s *apiServer) handleTrigger(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := trigger{
+			kind:   kind,
+			source: sourceManual,
+			stack:  r.PathValue("name"),
+			target: r.URL.Query().Get("target"),
+			done:   make(chan triggerResult, 1),
+		}
+
+		select {
+		case s.triggers <- t:
+		case <-r.Context().Done():
+			return
+		}
+
+		var result triggerResult
+		select {
+		case result = <-t.done:
+		case <-r.Context().Done():
+			return
+		}
+
+		if result.err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(result.err, errUnknownStack):
+				status = http.StatusNotFound
+			case errors.Is(result.err, errRepoNotReady), errors.Is(result.err, errNoPendingDeletion), errors.Is(result.err, errSuspended), errors.Is(result.err, errNotDegraded):
+				status = http.StatusConflict
+			}
+			writeError(w, status, result.err.Error())
+			return
+		}
+
+		succeeded, failed := summarizeResults(result.results)
+		writeJSON(w, http.StatusOK, TriggerResponse{Succeeded: succeeded, Failed: failed})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to encode API response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggerEndpoints(t *testing.T) {
+	triggers := make(chan trigger)
+	go func() {
+		for tr := range triggers {
+			if tr.stack == "missing" {
+				tr.done <- triggerResult{err: errUnknownStack}
+				continue
+			}
+			tr.done <- triggerResult{results: map[string]error{
+				"web": nil,
+				"db":  errors.New("boom"),
+			}}
+		}
+	}()
+	defer close(triggers)
+
+	server := &apiServer{
+		config:   newSharedConfig(Config{APIToken: "secret"}),
+		state:    newState(),
+		triggers: triggers,
+	}
+	handler := server.routes()
+
+	testCases := []struct {
+		name     string
+		path     string
+		token    string
+		expected int
+	}{
+		{name: "Missing token", path: "/api/sync", expected: http.StatusUnauthorized},
+		{name: "Wrong token", path: "/api/sync", token: "nope", expected: http.StatusUnauthorized},
+		{name: "Sync", path: "/api/sync", token: "secret", expected: http.StatusOK},
+		{name: "Redeploy all", path: "/api/redeploy", token: "secret", expected: http.StatusOK},
+		{name: "Redeploy stack", path: "/api/stacks/web/redeploy", token: "secret", expected: http.StatusOK},
+		{name: "Redeploy unknown stack", path: "/api/stacks/missing/redeploy", token: "secret", expected: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expected, rec.Code)
+		})
+	}
+}
+
+func TestTriggerEndpointsRequireToken(t *testing.T) {
+	server := &apiServer{config: newSharedConfig(Config{}), state: newState()}
+
+	rec := httptest.NewRecorder()
+	server.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/sync", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = httptest.NewRecorder()
+	server.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	sourcePoll    = "poll"
+	sourceStartup = "startup"
+	sourceManual  = "manual"
+)
+
+// AuditRecord is one reconcile pass as written to the audit log.
+type AuditRecord struct {
+	Time       time.Time     `json:"time"`
+	Source     string        `json:"source"`
+	Action     string        `json:"action"`
+	Stack      string        `json:"stack,omitempty"`
+	FromCommit string        `json:"from_commit,omitempty"`
+	ToCommit   string        `json:"to_commit,omitempty"`
+	Deployed   []string      `json:"deployed,omitempty"`
+	Deleted    []string      `json:"deleted,omitempty"`
+	Results    []StackResult `json:"results,omitempty"`
+	Duration   float64       `json:"duration_seconds"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// auditActions names what was done to a stack for each outcome of a result.
+var auditActions = map[string]string{
+	stackStatusDeployed: "deploy",
+	stackStatusRemoved:  "remove",
+	stackStatusKept:     "keep",
+	stackStatusOrphaned: "orphan",
+}
+
+type StackResult struct {
+	Stack       string `json:"stack"`
+	Action      string `json:"action"`
+	RenamedFrom string `json:"renamed_from,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type AuditFilter struct {
+	Stack string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// auditLog is an append-only JSON lines file. When it grows past maxSize it is
+// rotated to path.1, path.2, ... and the oldest file beyond maxFiles is dropped.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+}
+
+func newAuditLog(path string, maxSize int64, maxFiles int) *auditLog {
+	return &auditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+}
+
+func newAuditRecord(t trigger, fromCommit, toCommit string, started time.Time, result triggerResult) AuditRecord {
+	record := AuditRecord{
+		Time:       started,
+		Source:     t.source,
+		Action:     t.kind,
+		Stack:      t.stack,
+		FromCommit: fromCommit,
+		ToCommit:   toCommit,
+		Duration:   time.Since(started).Seconds(),
+	}
+	if result.err != nil {
+		record.Error = result.err.Error()
+	}
+
+	for _, key := range sortedKeys(result.results) {
+		stackName, outcome := parseResultKey(key)
+		stackResult := StackResult{Stack: stackName, Action: auditActions[outcome]}
+		if _, oldName, renamed := splitRenameKey(key); renamed {
+			stackResult.Action = "rename"
+			stackResult.RenamedFrom = oldName
+		}
+		switch outcome {
+		case stackStatusDeployed:
+			record.Deployed = append(record.Deployed, stackName)
+		case stackStatusRemoved:
+			record.Deleted = append(record.Deleted, stackName)
+		}
+		if err := result.results[key]; err != nil {
+			stackResult.Error = err.Error()
+		}
+		record.Results = append(record.Results, stackResult)
+	}
+
+	return record
+}
+
+func (l *auditLog) append(record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if info, err := os.Stat(l.path); err == nil && info.Size()+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return f.Sync()
+}
+
+func (l *auditLog) rotate() error {
+	os.Remove(l.rotatedPath(l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(l.path, l.rotatedPath(1))
+}
+
+func (l *auditLog) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// query returns the records matching filter, newest first.
+func (l *auditLog) query(filter AuditFilter) ([]AuditRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records := []AuditRecord{}
+	paths := []string{l.path}
+	for i := 1; i <= l.maxFiles; i++ {
+		paths = append(paths, l.rotatedPath(i))
+	}
+
+	for _, path := range paths {
+		fileRecords, err := readAuditFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range slices.Backward(fileRecords) {
+			if filter.matches(record) {
+				records = append(records, record)
+			}
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.After(records[j].Time)
+	})
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+func readAuditFile(path string) ([]AuditRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var record AuditRecord
+		// A torn last line after a crash shouldn't hide the rest of the log.
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func (f AuditFilter) matches(record AuditRecord) bool {
+	if !f.Since.IsZero() && record.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && record.Time.After(f.Until) {
+		return false
+	}
+	if f.Stack != "" {
+		return slices.ContainsFunc(record.Results, func(r StackResult) bool {
+			return r.Stack == f.Stack
+		})
+	}
+	return true
+}
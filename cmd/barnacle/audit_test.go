@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAuditRecord(t *testing.T) {
+	started := time.Now().Add(-2 * time.Second)
+	record := newAuditRecord(
+		trigger{kind: triggerSync, source: sourcePoll},
+		"aaaaaaa", "bbbbbbb", started,
+		triggerResult{results: map[string]error{
+			"web":           nil,
+			"db":            errors.New("boom"),
+			"old (deleted)": nil,
+		}},
+	)
+
+	assert.Equal(t, sourcePoll, record.Source)
+	assert.Equal(t, []string{"db", "web"}, record.Deployed)
+	assert.Equal(t, []string{"old"}, record.Deleted)
+	assert.Equal(t, []StackResult{
+		{Stack: "db", Action: "deploy", Error: "boom"},
+		{Stack: "old", Action: "remove"},
+		{Stack: "web", Action: "deploy"},
+	}, record.Results)
+	assert.GreaterOrEqual(t, record.Duration, 2.0)
+}
+
+func TestAuditLogRotationAndQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log := newAuditLog(path, 400, 2)
+
+	base := time.Date(2025, 10, 26, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		stack := "web"
+		if i%2 == 1 {
+			stack = "db"
+		}
+		require.NoError(t, log.append(AuditRecord{
+			Time:    base.Add(time.Duration(i) * time.Hour),
+			Source:  sourcePoll,
+			Action:  triggerSync,
+			Results: []StackResult{{Stack: stack, Action: "deploy"}},
+		}))
+	}
+
+	all, err := log.query(AuditFilter{})
+	require.NoError(t, err)
+	assert.Less(t, len(all), 10, "oldest records should have been rotated out")
+	assert.Equal(t, base.Add(9*time.Hour), all[0].Time, "newest record comes first")
+
+	limited, err := log.query(AuditFilter{Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, limited, 2)
+
+	db, err := log.query(AuditFilter{Stack: "db", Since: base.Add(6 * time.Hour)})
+	require.NoError(t, err)
+	require.Len(t, db, 2)
+	assert.Equal(t, base.Add(9*time.Hour), db[0].Time)
+	assert.Equal(t, base.Add(7*time.Hour), db[1].Time)
+}
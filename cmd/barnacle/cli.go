@@ -0,0 +1,324 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cliUsage = `Usage: barnacle [command]
+
+Without a command, barnacle runs the deployment loop.
+
+Commands:
+  sync              Pull the repository and deploy changes now
+  redeploy <stack>  Force a redeploy of a single stack
+  redeploy --all    Force a redeploy of every stack
+  history           Show recent reconciles from the audit log
+                      --stack NAME   only passes that touched NAME
+                      --since 24h    only passes after a duration ago or RFC 3339 time
+                      --until TIME   only passes before a duration ago or RFC 3339 time
+                      --limit N      at most N passes (default 20)
+  targets           Show the Docker targets and what is deployed to each
+  deletions         Show stack removals held back by DELETE_THRESHOLD
+  confirm-deletion  Remove the held stacks that are still gone from the repo
+  clear-degraded [target]
+                    Allow stack removals again after a state file could not
+                    be loaded, once the deployed stacks have been checked
+  healthcheck       Exit non-zero unless /healthz reports ok
+
+The commands talk to a running barnacle over its API. They read API_URL
+(default derived from API_ADDR) and API_TOKEN from CONFIG_FILE or the
+environment.
+`
+
+func runCLI(args []string) int {
+	s, err := loadSettings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	var path string
+
+	switch args[0] {
+	case "sync":
+		path = "/api/sync"
+	case "redeploy":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, cliUsage)
+			return 2
+		}
+		if args[1] == "--all" {
+			path = "/api/redeploy"
+		} else {
+			path = "/api/stacks/" + url.PathEscape(args[1]) + "/redeploy"
+		}
+	case "confirm-deletion":
+		path = "/api/deletions/confirm"
+	case "clear-degraded":
+		path = "/api/state/clear-degraded"
+		if len(args) > 1 {
+			path += "?target=" + url.QueryEscape(args[1])
+		}
+	case "history":
+		return runHistory(s, args[1:])
+	case "targets":
+		return runTargets(s)
+	case "deletions":
+		return runDeletions(s)
+	case "healthcheck":
+		return runHealthcheck(s)
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", args[0], cliUsage)
+		return 2
+	}
+
+	response, err := postTrigger(s, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	printTriggerResponse(response)
+	if len(response.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func apiBaseURL(s settings) string {
+	if apiURL := s.get("API_URL", ""); apiURL != "" {
+		return strings.TrimSuffix(apiURL, "/")
+	}
+
+	addr := s.get("API_ADDR", defaultAPIAddr)
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return "http://" + addr
+}
+
+func postTrigger(s settings, path string) (*TriggerResponse, error) {
+	var response TriggerResponse
+	if err := callAPI(s, http.MethodPost, path, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// apiDisabled reports whether API_ADDR=off leaves nothing to talk to.
+func apiDisabled(s settings) bool {
+	return s.get("API_URL", "") == "" && s.get("API_ADDR", defaultAPIAddr) == "off"
+}
+
+func callAPI(s settings, method string, path string, v any) error {
+	if apiDisabled(s) {
+		return errors.New("the API is disabled with API_ADDR=off")
+	}
+	req, err := http.NewRequest(method, apiBaseURL(s)+path, nil)
+	if err != nil {
+		return err
+	}
+	if token := s.get("API_TOKEN", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach barnacle: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s (HTTP %d)", apiErr.Error, resp.StatusCode)
+		}
+		return fmt.Errorf("unexpected HTTP %d", resp.StatusCode)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func runHistory(s settings, args []string) int {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	stack := flags.String("stack", "", "only passes that touched this stack")
+	since := flags.String("since", "", "only passes after this duration ago or RFC 3339 time")
+	until := flags.String("until", "", "only passes before this duration ago or RFC 3339 time")
+	limit := flags.Int("limit", 20, "maximum number of passes")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(*limit))
+	if *stack != "" {
+		query.Set("stack", *stack)
+	}
+	if *since != "" {
+		query.Set("since", *since)
+	}
+	if *until != "" {
+		query.Set("until", *until)
+	}
+
+	var records []AuditRecord
+	if err := callAPI(s, http.MethodGet, "/api/audit?"+query.Encode(), &records); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if len(records) == 0 {
+		fmt.Println("No history")
+		return 0
+	}
+
+	for _, record := range records {
+		commits := shortHash(record.ToCommit)
+		if record.FromCommit != "" && record.FromCommit != record.ToCommit {
+			commits = shortHash(record.FromCommit) + ".." + commits
+		}
+		fmt.Printf("%s  %-7s %-12s %-16s %6.1fs\n",
+			record.Time.Local().Format(time.DateTime), record.Source, record.Action, commits, record.Duration)
+
+		if record.Error != "" {
+			fmt.Printf("    ✗ %s\n", record.Error)
+		}
+		for _, result := range record.Results {
+			if result.Error != "" {
+				fmt.Printf("    ✗ %s %s: %s\n", result.Action, result.Stack, result.Error)
+			} else {
+				fmt.Printf("    ✓ %s %s\n", result.Action, result.Stack)
+			}
+		}
+	}
+	return 0
+}
+
+func runTargets(s settings) int {
+	var targets []TargetStatus
+	if err := callAPI(s, http.MethodGet, "/api/targets", &targets); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	for _, target := range targets {
+		endpoint := cmp.Or(target.Host, target.Context, "barnacle's own Docker engine")
+		fmt.Printf("%s (%s): %d stacks", target.Name, endpoint, target.Stacks)
+		if !target.LastDeploy.IsZero() {
+			fmt.Printf(", deployed %s", target.LastDeploy.Local().Format(time.DateTime))
+		}
+		fmt.Println()
+		if target.LastError != "" {
+			fmt.Printf("  error: %s\n", target.LastError)
+		}
+		if target.Degraded != "" {
+			fmt.Printf("  state degraded: %s\n", target.Degraded)
+		}
+	}
+	return 0
+}
+
+// runDeletions shows the held removals on every target.
+func runDeletions(s settings) int {
+	var targets []TargetStatus
+	if err := callAPI(s, http.MethodGet, "/api/targets", &targets); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	held := false
+	for _, target := range targets {
+		pending := target.PendingDeletion
+		if pending == nil {
+			continue
+		}
+		held = true
+
+		fmt.Printf("%s, held since %s: %s\n", target.Name, pending.Since.Local().Format(time.DateTime), pending.Reason)
+		for _, stackName := range pending.Stacks {
+			fmt.Printf("  %s\n", stackName)
+		}
+	}
+
+	if !held {
+		fmt.Println("No stack removal is waiting for confirmation")
+		return 0
+	}
+	fmt.Println("Run `barnacle confirm-deletion` to remove them.")
+	return 0
+}
+
+func runHealthcheck(s settings) int {
+	// With the API off there is nothing to ask, and an unhealthy report
+	// would only get the container restarted for it.
+	if apiDisabled(s) {
+		fmt.Println("API disabled, not checked")
+		return 0
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(apiBaseURL(s) + "/healthz")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to reach barnacle: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	var health HealthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to decode response: %v\n", err)
+		return 1
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Unhealthy: %s\n", health.Reason)
+		return 1
+	}
+	fmt.Println(health.Status)
+	return 0
+}
+
+func printTriggerResponse(response *TriggerResponse) {
+	if len(response.Succeeded) == 0 && len(response.Failed) == 0 {
+		fmt.Println("Nothing to deploy")
+		return
+	}
+
+	for _, stackName := range response.Succeeded {
+		fmt.Printf("✓ %s\n", stackName)
+	}
+
+	failed := make([]string, 0, len(response.Failed))
+	for stackName := range response.Failed {
+		failed = append(failed, stackName)
+	}
+	sort.Strings(failed)
+	for _, stackName := range failed {
+		fmt.Printf("✗ %s: %s\n", stackName, response.Failed[stackName])
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// maxDeepenDepth bounds how far a shallow clone is deepened looking for a
+// commit before changes fall back to redeploying every stack.
+const maxDeepenDepth = 3200
+
+// parseSparseDirs reads SPARSE_CHECKOUT and SPARSE_PATHS into the directories
+// to check out: the stacks root, and any others stacks share files from.
+func parseSparseDirs(enabled bool, stacksRoot, extra string) ([]string, error) {
+	if !enabled {
+		if extra != "" {
+			return nil, errors.New("SPARSE_PATHS needs SPARSE_CHECKOUT=true")
+		}
+		return nil, nil
+	}
+	if stacksRoot == "" {
+		return nil, errors.New("SPARSE_CHECKOUT needs STACKS_ROOT, since stacks at the repository root cover all of it")
+	}
+
+	dirs := []string{stacksRoot}
+	for _, dir := range strings.Split(extra, ",") {
+		dir = filepath.ToSlash(filepath.Clean(strings.TrimSpace(dir)))
+		if dir == "." {
+			continue
+		}
+		if !filepath.IsLocal(dir) {
+			return nil, fmt.Errorf("SPARSE_PATHS must be paths inside the repository, got %q", dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// cloneRepo clones the repository as CLONE_DEPTH, SINGLE_BRANCH and
+// SPARSE_CHECKOUT ask, and checks out the commit DEPLOY_REF picks.
+func cloneRepo(ctx context.Context, config Config, auth transport.AuthMethod) (*git.Repository, error) {
+	// Every tag and its history is only needed to resolve a pin. Otherwise
+	// only tags on the fetched history come along, as on later fetches, so
+	// SINGLE_BRANCH and CLONE_DEPTH keep the clone small.
+	tags := git.TagFollowing
+	if config.DeployRef.pinned() {
+		tags = git.AllTags
+	}
+	repo, err := git.PlainCloneContext(ctx, config.RepoPath, false, &git.CloneOptions{
+		URL:           config.RepoURL,
+		Auth:          auth,
+		ReferenceName: plumbing.NewBranchReferenceName(config.Branch),
+		SingleBranch:  config.SingleBranch,
+		Depth:         config.CloneDepth,
+		Tags:          tags,
+		// A sparse checkout is written below, rather than the whole tree
+		// first.
+		NoCheckout: len(config.SparseDirs) > 0,
+		Progress:   os.Stdout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get worktree: %w", err)
+	}
+
+	// A fresh clone has to start out on the pin so the first deploy is the
+	// pinned commit; an existing one moves to it on its first pull.
+	if config.DeployRef.pinned() {
+		target, name, err := resolveRef(repo, config.DeployRef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve DEPLOY_REF %s: %w", config.DeployRef, err)
+		}
+		if err := w.Checkout(&git.CheckoutOptions{Hash: target, Force: true, SparseCheckoutDirectories: config.SparseDirs}); err != nil {
+			return nil, fmt.Errorf("failed to check out %s: %w", name, err)
+		}
+		slog.Info("Checked out pinned ref", "ref", name, "commit", shortHash(target.String()))
+	} else if len(config.SparseDirs) > 0 {
+		if err := w.ResetSparsely(&git.ResetOptions{Mode: git.HardReset}, config.SparseDirs); err != nil {
+			return nil, fmt.Errorf("failed to check out %s: %w", config.Branch, err)
+		}
+	}
+	return repo, nil
+}
+
+// isAncestor reports whether ancestor is in commit's history, as far as that
+// history is available: the boundary of a shallow clone ends the search.
+func isAncestor(repo *git.Repository, ancestor, commit plumbing.Hash) (bool, error) {
+	seen := map[plumbing.Hash]bool{commit: true}
+	queue := []plumbing.Hash{commit}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if hash == ancestor {
+			return true, nil
+		}
+
+		c, err := repo.CommitObject(hash)
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, parent := range c.ParentHashes {
+			if !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return false, nil
+}
+
+// deepenHistory fetches more of a shallow clone's history, doubling the depth
+// each time, until commit is available locally.
+func deepenHistory(ctx context.Context, repo *git.Repository, auth transport.AuthMethod, commit plumbing.Hash, depth int) error {
+	for depth = max(depth, 50) * 2; depth <= maxDeepenDepth; depth *= 2 {
+		slog.Info("Deepening shallow clone", "phase", "sync", "commit", shortHash(commit.String()), "depth", depth)
+		err := repo.FetchContext(ctx, &git.FetchOptions{Auth: auth, Depth: depth, Force: true})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return fmt.Errorf("failed to deepen clone: %w", err)
+		}
+		if _, err := repo.CommitObject(commit); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("commit %s is not within %d commits of the remote", shortHash(commit.String()), maxDeepenDepth)
+}
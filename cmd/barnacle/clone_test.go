@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSparseDirs(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		stacksRoot string
+		extra      string
+		expected   []string
+		expectErr  bool
+	}{
+		{name: "off", stacksRoot: "stacks"},
+		{name: "stacks root", enabled: true, stacksRoot: "stacks", expected: []string{"stacks"}},
+		{name: "shared paths", enabled: true, stacksRoot: "deploy/stacks", extra: "deploy/common, configs/", expected: []string{"deploy/stacks", "deploy/common", "configs"}},
+		{name: "no stacks root", enabled: true, expectErr: true},
+		{name: "path outside repo", enabled: true, stacksRoot: "stacks", extra: "../etc", expectErr: true},
+		{name: "paths without sparse checkout", stacksRoot: "stacks", extra: "common", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dirs, err := parseSparseDirs(tc.enabled, tc.stacksRoot, tc.extra)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, dirs)
+		})
+	}
+}
+
+func TestSparseCheckoutKeepsToStacksRoot(t *testing.T) {
+	upstreamPath := t.TempDir()
+	upstream, err := git.PlainInit(upstreamPath, false)
+	require.NoError(t, err)
+	for _, dir := range []string{"stacks/web", "assets"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(upstreamPath, dir), 0755))
+	}
+	commitFile(t, upstream, "stacks/web/compose.yml", &git.CommitOptions{})
+	commitFile(t, upstream, "assets/logo.png", &git.CommitOptions{})
+	head, err := upstream.Head()
+	require.NoError(t, err)
+
+	config := Config{
+		RepoURL:    upstreamPath,
+		RepoPath:   t.TempDir(),
+		Branch:     head.Name().Short(),
+		SparseDirs: []string{"stacks"},
+	}
+	repo, err := cloneRepo(context.Background(), config, nil)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(config.RepoPath, "stacks/web/compose.yml"))
+	assert.NoFileExists(t, filepath.Join(config.RepoPath, "assets/logo.png"))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(upstreamPath, "stacks/db"), 0755))
+	commitFile(t, upstream, "stacks/db/compose.yml", &git.CommitOptions{})
+	commitFile(t, upstream, "assets/banner.png", &git.CommitOptions{})
+
+	update, err := fetchAndCheckout(context.Background(), repo, config, nil, plumbing.ZeroHash)
+	require.NoError(t, err)
+	require.NotNil(t, update)
+	assert.ElementsMatch(t, []string{"stacks/db/compose.yml", "assets/banner.png"}, update.changedFiles)
+	assert.FileExists(t, filepath.Join(config.RepoPath, "stacks/db/compose.yml"))
+	assert.NoFileExists(t, filepath.Join(config.RepoPath, "assets/logo.png"))
+	assert.NoFileExists(t, filepath.Join(config.RepoPath, "assets/banner.png"))
+}
+
+func TestHistoryWalksStopAtShallowBoundary(t *testing.T) {
+	repo, err := git.PlainInit(t.TempDir(), false)
+	require.NoError(t, err)
+
+	// A parent that is not in the repository stands in for the boundary of a
+	// shallow clone.
+	first, err := repo.CommitObject(commitFile(t, repo, "a", &git.CommitOptions{}))
+	require.NoError(t, err)
+	first.ParentHashes = []plumbing.Hash{plumbing.NewHash("1111111111111111111111111111111111111111")}
+	encoded := repo.Storer.NewEncodedObject()
+	require.NoError(t, first.Encode(encoded))
+	base, err := repo.Storer.SetEncodedObject(encoded)
+	require.NoError(t, err)
+	head, err := repo.Head()
+	require.NoError(t, err)
+	require.NoError(t, repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), base)))
+
+	tip := commitFile(t, repo, "b", &git.CommitOptions{})
+
+	ancestor, err := isAncestor(repo, base, tip)
+	require.NoError(t, err)
+	assert.True(t, ancestor)
+
+	ancestor, err = isAncestor(repo, plumbing.NewHash("2222222222222222222222222222222222222222"), tip)
+	require.NoError(t, err)
+	assert.False(t, ancestor)
+
+	commits, err := commitsBetween(repo, base, tip)
+	require.NoError(t, err)
+	assert.Equal(t, []plumbing.Hash{tip}, commits)
+
+	commits, err = commitsBetween(repo, plumbing.NewHash("2222222222222222222222222222222222222222"), tip)
+	require.NoError(t, err)
+	assert.Equal(t, []plumbing.Hash{tip, base}, commits)
+}
+
+func TestShallowCloneDeepensToDeployedCommit(t *testing.T) {
+	upstreamPath := t.TempDir()
+	upstream, err := git.PlainInit(upstreamPath, false)
+	require.NoError(t, err)
+	deployed := commitFile(t, upstream, "a", &git.CommitOptions{})
+	commitFile(t, upstream, "b", &git.CommitOptions{})
+	commitFile(t, upstream, "c", &git.CommitOptions{})
+	head, err := upstream.Head()
+	require.NoError(t, err)
+
+	config := Config{
+		RepoURL:    "file://" + upstreamPath,
+		RepoPath:   t.TempDir(),
+		Branch:     head.Name().Short(),
+		CloneDepth: 1,
+	}
+	repo, err := cloneRepo(context.Background(), config, nil)
+	require.NoError(t, err)
+	_, err = repo.CommitObject(deployed)
+	require.ErrorIs(t, err, plumbing.ErrObjectNotFound, "the deployed commit is outside the shallow clone")
+
+	commitFile(t, upstream, "d", &git.CommitOptions{})
+
+	update, err := fetchAndCheckout(context.Background(), repo, config, nil, deployed)
+	require.NoError(t, err)
+	require.NotNil(t, update)
+	assert.Equal(t, deployed, update.from)
+	assert.ElementsMatch(t, []string{"b", "c", "d"}, update.changedFiles)
+	_, err = repo.CommitObject(deployed)
+	assert.NoError(t, err, "the clone was deepened to the deployed commit")
+}
+
+func TestShallowSingleBranchCloneSkipsUnrelatedTags(t *testing.T) {
+	upstreamPath := t.TempDir()
+	upstream, err := git.PlainInit(upstreamPath, false)
+	require.NoError(t, err)
+	commitFile(t, upstream, "a", &git.CommitOptions{})
+	head, err := upstream.Head()
+	require.NoError(t, err)
+
+	w, err := upstream.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("feature"), Create: true}))
+	unrelated := commitFile(t, upstream, "b", &git.CommitOptions{})
+	_, err = upstream.CreateTag("v1.0.0", unrelated, nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Checkout(&git.CheckoutOptions{Branch: head.Name()}))
+
+	config := Config{
+		RepoURL:      "file://" + upstreamPath,
+		RepoPath:     t.TempDir(),
+		Branch:       head.Name().Short(),
+		SingleBranch: true,
+		CloneDepth:   1,
+	}
+	repo, err := cloneRepo(context.Background(), config, nil)
+	require.NoError(t, err)
+
+	_, err = repo.Tag("v1.0.0")
+	assert.ErrorIs(t, err, git.ErrTagNotFound)
+	_, err = repo.CommitObject(unrelated)
+	assert.ErrorIs(t, err, plumbing.ErrObjectNotFound)
+}
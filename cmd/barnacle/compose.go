@@ -0,0 +1,156 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// composeProject is how a stack is handed to docker compose: the project
+// name plus the files, profiles and env files from its manifest, and the
+// Docker target it runs on. Every compose command for the stack is built from
+// it so up and down agree.
+type composeProject struct {
+	stack   string
+	runtime containerRuntime
+	target  dockerTarget
+	// name is passed to compose with -p only when it is pinned. Otherwise
+	// compose names the project itself, from the directory, a top-level
+	// name: or COMPOSE_PROJECT_NAME, and name is filled in from its config.
+	name     string
+	pinned   bool
+	dir      string
+	files    []string
+	profiles []string
+	envFiles []string
+	upFlags  []string
+}
+
+// overlaysDirName holds per-environment and per-host compose files inside a
+// stack, as overlays/<name>/*.yml.
+const overlaysDirName = "overlays"
+
+// newComposeProject describes the stack at stackPath for the runtime and
+// Docker target in config, with the config's overlays layered on top. An
+// empty projectName leaves naming the project to compose. Once the directory
+// is gone only the project name and target are left, which is still enough
+// for down.
+func newComposeProject(config Config, stackName, stackPath, projectName string, manifest stackManifest) composeProject {
+	project := composeProject{stack: stackName, runtime: config.runtime(), target: config.Target, name: projectName, pinned: projectName != ""}
+	if _, err := os.Stat(stackPath); err != nil {
+		return project
+	}
+
+	project.dir = stackPath
+	project.files = slices.Clone(composeFiles(stackPath))
+	project.profiles = manifest.Profiles
+	project.envFiles = manifest.EnvFiles
+
+	var overlayEnvFiles []string
+	for _, name := range config.overlays() {
+		overlayFiles, _ := filepath.Glob(filepath.Join(stackPath, overlaysDirName, name, "*.y*ml"))
+		sort.Strings(overlayFiles)
+		for _, file := range overlayFiles {
+			rel, _ := filepath.Rel(stackPath, file)
+			project.files = append(project.files, rel)
+		}
+		if _, err := os.Stat(filepath.Join(stackPath, name+".env")); err == nil {
+			overlayEnvFiles = append(overlayEnvFiles, name+".env")
+		}
+	}
+	// Passing any --env-file stops compose reading .env, so keep it first.
+	if len(overlayEnvFiles) > 0 && len(project.envFiles) == 0 {
+		if _, err := os.Stat(filepath.Join(stackPath, ".env")); err == nil {
+			project.envFiles = []string{".env"}
+		}
+	}
+	project.envFiles = append(project.envFiles, overlayEnvFiles...)
+
+	for _, flag := range manifest.UpFlags {
+		project.upFlags = append(project.upFlags, strings.Fields(flag)...)
+	}
+	return project
+}
+
+// args returns the global compose flags for the project, with extraFiles
+// layered on top of its own compose files.
+func (p composeProject) args(extraFiles ...string) []string {
+	var args []string
+	if p.pinned {
+		args = append(args, "-p", p.name)
+	}
+	for _, envFile := range p.envFiles {
+		args = append(args, "--env-file", envFile)
+	}
+	for _, profile := range p.profiles {
+		args = append(args, "--profile", profile)
+	}
+	if p.dir == "" {
+		return args
+	}
+	for _, file := range append(p.files, extraFiles...) {
+		args = append(args, "-f", file)
+	}
+	return args
+}
+
+// command builds a compose invocation for the project, pointed at its target
+// and run from its directory.
+func (p composeProject) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := p.runtime.compose(ctx, args...)
+	cmd.Dir = p.workDir()
+	cmd.Env = p.target.env()
+	return cmd
+}
+
+// workDir is where compose runs, so relative paths resolve as they do for
+// someone running compose in the stack directory.
+func (p composeProject) workDir() string {
+	if p.dir == "" {
+		return "/"
+	}
+	return p.dir
+}
+
+// configDigest hashes the project's resolved compose config, without the
+// label override, so it changes exactly when the stack's own config does.
+func configDigest(ctx context.Context, project composeProject) (string, error) {
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	resolved, err := composeConfig(cmdCtx, project)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(resolved)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// resolveProjectName asks compose which name it gives a project that barnacle
+// does not pin, falling back to the name it derives from the directory.
+func resolveProjectName(ctx context.Context, project composeProject) (string, error) {
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	resolved, err := composeConfig(cmdCtx, project)
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		Name string `yaml:"name"`
+	}
+	if err := yaml.Unmarshal(resolved, &config); err != nil {
+		return "", fmt.Errorf("failed to parse compose config: %w", err)
+	}
+	return cmp.Or(config.Name, composeProjectName(project.stack)), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComposeProjectArgs(t *testing.T) {
+	stackPath := t.TempDir()
+	manifest := `
+files: [compose.yml, compose.prod.yml]
+profiles: [web, metrics]
+project: shop
+env_files: [../common/.env]
+up_flags: [--build, --pull always]
+`
+	require.NoError(t, os.WriteFile(filepath.Join(stackPath, manifestFileName), []byte(manifest), 0644))
+
+	m, err := loadStackManifest(stackPath)
+	require.NoError(t, err)
+
+	state := newState()
+	state.recordManifest("shop-v1", m)
+	project := newComposeProject(Config{}, "shop-v1", stackPath, state.stackProject("shop-v1"), m)
+
+	assert.Equal(t, []string{
+		"-p", "shop",
+		"--env-file", "../common/.env",
+		"--profile", "web", "--profile", "metrics",
+		"-f", "compose.yml", "-f", "compose.prod.yml", "-f", "/tmp/override.yml",
+	}, project.args("/tmp/override.yml"))
+	assert.Equal(t, []string{"--build", "--pull", "always"}, project.upFlags)
+	assert.Equal(t, stackPath, project.workDir())
+
+	// Once the directory is gone, down only has the project name to go on.
+	gone := newComposeProject(Config{}, "shop-v1", filepath.Join(stackPath, "missing"), "shop", stackManifest{})
+	assert.Equal(t, []string{"-p", "shop"}, gone.args())
+	assert.Equal(t, "/", gone.workDir())
+}
+
+// TestUnpinnedProjectIsNamedByCompose swaps docker for a script that names
+// the project the way a top-level name: in the compose file would.
+func TestUnpinnedProjectIsNamedByCompose(t *testing.T) {
+	binDir := t.TempDir()
+	script := "#!/bin/sh\necho \"$*\" > " + filepath.Join(binDir, "args") + "\necho 'name: shop'\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "docker"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	stackPath := filepath.Join(binDir, "web")
+	require.NoError(t, os.MkdirAll(stackPath, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(stackPath, "compose.yml"), []byte("services: {}\n"), 0644))
+
+	state := newState()
+	state.recordManifest("web", stackManifest{})
+	project := newComposeProject(Config{}, "web", stackPath, state.pinnedProject("web"), stackManifest{})
+	assert.Equal(t, []string{"-f", "compose.yml"}, project.args())
+
+	name, err := resolveProjectName(context.Background(), project)
+	require.NoError(t, err)
+	assert.Equal(t, "shop", name)
+	args, err := os.ReadFile(filepath.Join(binDir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "compose -f compose.yml config\n", string(args))
+
+	// Down, or a rename, goes by the name compose gave the project.
+	state.recordComposeProject("web", name)
+	assert.Equal(t, "shop", state.stackProject("web"))
+	state.renameStack("web", "shop-web")
+	assert.Equal(t, "shop", state.pinnedProject("shop-web"))
+}
+
+func TestLoadStackManifestRejectsInvalidProject(t *testing.T) {
+	stackPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(stackPath, manifestFileName), []byte("project: My App\n"), 0644))
+
+	_, err := loadStackManifest(stackPath)
+	assert.ErrorContains(t, err, "invalid project name")
+}
+
+func TestComposeProjectOverlays(t *testing.T) {
+	stackPath := t.TempDir()
+	for _, file := range []string{
+		"compose.yml",
+		".env",
+		"production.env",
+		"overlays/production/compose.override.yml",
+		"overlays/production/replicas.yaml",
+		"overlays/web-1/compose.override.yml",
+		"overlays/staging/compose.override.yml",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(stackPath, file)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(stackPath, file), nil, 0644))
+	}
+
+	config := Config{Environment: "production", HostName: "web-1"}
+	project := newComposeProject(config, "web", stackPath, "web", stackManifest{})
+
+	assert.Equal(t, []string{
+		"compose.yml",
+		"overlays/production/compose.override.yml",
+		"overlays/production/replicas.yaml",
+		"overlays/web-1/compose.override.yml",
+	}, project.files)
+	assert.Equal(t, []string{".env", "production.env"}, project.envFiles)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigFile = "/app/config.yml"
+
+type Config struct {
+	RepoURL     string
+	RepoPath    string
+	InstanceID  string
+	Environment string
+	HostName    string
+	HostLabels  map[string]string
+	StatePath   string
+	Branch      string
+	// DeployRef pins the deployed commit to a tag, semver range or commit
+	// instead of the tip of Branch.
+	DeployRef      refPolicy
+	DiscordWebhook string
+	APIAddr        string
+	APIToken       string
+
+	// Runtime is the container CLI stacks are deployed with.
+	Runtime containerRuntime
+
+	// Targets are the Docker engines besides the local one that stacks can
+	// be deployed to. Target is the one the current pass deploys to.
+	Targets []dockerTarget
+	Target  dockerTarget
+
+	StacksRoot    string
+	StacksDepth   int
+	StacksInclude []string
+	StacksExclude []string
+
+	// CloneDepth limits a fresh clone to that many commits, and SingleBranch
+	// to Branch. SparseDirs, when set, are the only directories checked out.
+	CloneDepth   int
+	SingleBranch bool
+	SparseDirs   []string
+
+	// VerifySignatures is off, head or all: which new commits need a
+	// signature from GPGKeyring or SSHAllowedSigners before deploying.
+	VerifySignatures  string
+	GPGKeyring        string
+	SSHAllowedSigners string
+
+	// Policy is what stacks are checked against before they are deployed.
+	Policy deployPolicy
+
+	DeleteThreshold     deleteThreshold
+	DeletePolicy        string
+	StackDeletePolicies map[string]string
+
+	AuditLogPath     string
+	AuditLogMaxSize  int64
+	AuditLogMaxFiles int
+
+	LogLevel            string
+	LogFormat           string
+	LivenessTimeout     time.Duration
+	ReadinessMaxSyncAge time.Duration
+	ShutdownTimeout     time.Duration
+}
+
+// settings holds the scalar values from the optional config file, keyed by
+// the environment variable they stand in for. File values win over the
+// environment so that they can be changed and picked up with SIGHUP.
+type settings map[string]string
+
+func loadSettings() (settings, error) {
+	path := getEnv("CONFIG_FILE", defaultConfigFile)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return settings{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	s := settings{}
+	for key, value := range raw {
+		switch value.(type) {
+		case map[string]any, []any, nil:
+			continue
+		}
+		s[strings.ToUpper(key)] = fmt.Sprint(value)
+	}
+	return s, nil
+}
+
+// defaultAPIAddr keeps the API on the loopback interface, where the CLI and
+// the healthcheck reach it, until a token is set.
+const defaultAPIAddr = "127.0.0.1:8080"
+
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s settings) get(key, defaultValue string) string {
+	if value := s[key]; value != "" {
+		return value
+	}
+	return getEnv(key, defaultValue)
+}
+
+func (s settings) duration(key string, defaultValue time.Duration) time.Duration {
+	value := s.get(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid duration, using default", "key", key, "value", value, "default", defaultValue)
+		return defaultValue
+	}
+	return duration
+}
+
+func (s settings) int(key string, defaultValue int) int {
+	value := s.get(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid number, using default", "key", key, "value", value, "default", defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func (s settings) bool(key string, defaultValue bool) bool {
+	value := s.get(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("Invalid boolean, using default", "key", key, "value", value, "default", defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+func loadConfig() (Config, error) {
+	s, err := loadSettings()
+	if err != nil {
+		return Config{}, err
+	}
+
+	repoURL := s.get("REPO_URL", "")
+	if repoURL == "" {
+		return Config{}, errors.New("REPO_URL environment variable is required")
+	}
+
+	repoName := extractRepoName(repoURL)
+	repoPath := s.get("REPO_PATH", fmt.Sprintf("/opt/%s", repoName))
+
+	stacksRoot := filepath.ToSlash(filepath.Clean(s.get("STACKS_ROOT", ".")))
+	if !filepath.IsLocal(stacksRoot) {
+		return Config{}, fmt.Errorf("STACKS_ROOT must be a path inside the repository, got %q", stacksRoot)
+	}
+	if stacksRoot == "." {
+		stacksRoot = ""
+	}
+
+	stacksInclude, err := parseStackPatterns("STACKS_INCLUDE", s.get("STACKS_INCLUDE", ""))
+	if err != nil {
+		return Config{}, err
+	}
+	stacksExclude, err := parseStackPatterns("STACKS_EXCLUDE", s.get("STACKS_EXCLUDE", ""))
+	if err != nil {
+		return Config{}, err
+	}
+
+	threshold, err := parseDeleteThreshold(s.get("DELETE_THRESHOLD", "50%"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	deletePolicy, err := parseDeletePolicy(s.get("DELETE_POLICY", deletePolicyDown))
+	if err != nil {
+		return Config{}, fmt.Errorf("DELETE_POLICY: %w", err)
+	}
+
+	stackDeletePolicies, err := parseStackDeletePolicies(s.get("STACK_DELETE_POLICIES", ""))
+	if err != nil {
+		return Config{}, err
+	}
+
+	hostLabels, err := parseHostLabels(s.get("HOST_LABELS", ""))
+	if err != nil {
+		return Config{}, err
+	}
+
+	verifySignatures, err := parseVerifySignatures(s.get("VERIFY_SIGNATURES", verifySignaturesOff))
+	if err != nil {
+		return Config{}, err
+	}
+	gpgKeyring, sshAllowedSigners := s.get("GPG_KEYRING", ""), s.get("SSH_ALLOWED_SIGNERS", "")
+	if verifySignatures != verifySignaturesOff && gpgKeyring == "" && sshAllowedSigners == "" {
+		return Config{}, errors.New("VERIFY_SIGNATURES needs GPG_KEYRING or SSH_ALLOWED_SIGNERS")
+	}
+
+	sparseDirs, err := parseSparseDirs(s.bool("SPARSE_CHECKOUT", false), stacksRoot, s.get("SPARSE_PATHS", ""))
+	if err != nil {
+		return Config{}, err
+	}
+
+	apiAddr, apiToken := s.get("API_ADDR", defaultAPIAddr), s.get("API_TOKEN", "")
+	if apiAddr == "off" {
+		apiAddr = ""
+	}
+	if apiAddr != "" && apiToken == "" && !isLoopbackAddr(apiAddr) {
+		return Config{}, fmt.Errorf("API_ADDR %s listens beyond localhost, which needs API_TOKEN", apiAddr)
+	}
+
+	deployRef, err := parseRefPolicy(s.get("DEPLOY_REF", refBranch))
+	if err != nil {
+		return Config{}, err
+	}
+
+	policy, err := loadPolicy(s.get("POLICY_FILE", ""))
+	if err != nil {
+		return Config{}, err
+	}
+
+	runtime, err := parseRuntime(s.get("CONTAINER_RUNTIME", runtimeAuto))
+	if err != nil {
+		return Config{}, err
+	}
+
+	targets, err := parseDockerTargets(s.get("DOCKER_TARGETS", ""), s.get("DOCKER_TARGET_CERTS", "/app/certs"), s.get("DOCKER_TARGETS_INSECURE", ""))
+	if err != nil {
+		return Config{}, err
+	}
+	if err := checkTargetRuntime(runtime, targets); err != nil {
+		return Config{}, err
+	}
+
+	config := Config{
+		RepoURL:        repoURL,
+		RepoPath:       repoPath,
+		InstanceID:     s.get("INSTANCE_ID", "default"),
+		Environment:    s.get("ENVIRONMENT", ""),
+		HostName:       s.get("HOST_NAME", ""),
+		HostLabels:     hostLabels,
+		StatePath:      s.get("STATE_PATH", "/app/barnacle-state.json"),
+		Branch:         s.get("BRANCH", "main"),
+		DeployRef:      deployRef,
+		DiscordWebhook: s.get("DISCORD_WEBHOOK", ""),
+		APIAddr:        apiAddr,
+		APIToken:       apiToken,
+
+		Runtime: runtime,
+		Targets: targets,
+
+		StacksRoot:    stacksRoot,
+		StacksDepth:   s.int("STACKS_DEPTH", 1),
+		StacksInclude: stacksInclude,
+		StacksExclude: stacksExclude,
+
+		CloneDepth:   max(s.int("CLONE_DEPTH", 0), 0),
+		SingleBranch: s.bool("SINGLE_BRANCH", false),
+		SparseDirs:   sparseDirs,
+
+		VerifySignatures:  verifySignatures,
+		GPGKeyring:        gpgKeyring,
+		SSHAllowedSigners: sshAllowedSigners,
+
+		Policy: policy,
+
+		DeleteThreshold:     threshold,
+		DeletePolicy:        deletePolicy,
+		StackDeletePolicies: stackDeletePolicies,
+
+		AuditLogPath:     s.get("AUDIT_LOG", "/app/barnacle-audit.jsonl"),
+		AuditLogMaxSize:  int64(s.int("AUDIT_LOG_MAX_SIZE_MB", 10)) * 1024 * 1024,
+		AuditLogMaxFiles: s.int("AUDIT_LOG_MAX_FILES", 5),
+
+		LogLevel:            s.get("LOG_LEVEL", "info"),
+		LogFormat:           s.get("LOG_FORMAT", "text"),
+		LivenessTimeout:     s.duration("LIVENESS_TIMEOUT", 15*time.Minute),
+		ReadinessMaxSyncAge: s.duration("READINESS_MAX_SYNC_AGE", 10*pollInterval),
+		ShutdownTimeout:     s.duration("SHUTDOWN_TIMEOUT", 2*time.Minute),
+	}
+
+	return config, nil
+}
+
+// overlays are the overlay names this instance picks up in each stack, the
+// environment's before the host's and the host's before the Docker target's,
+// so the more specific ones win.
+func (c Config) overlays() []string {
+	var names []string
+	for _, name := range []string{c.Environment, c.HostName, c.Target.Name} {
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseHostLabels reads HOST_LABELS, a comma separated list such as
+// "role=edge,region=eu".
+func parseHostLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, labelValue, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid HOST_LABELS entry %q: want key=value", entry)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(labelValue)
+	}
+	return labels, nil
+}
+
+// identity describes this instance and the target it deploys to for
+// notifications, e.g. "web-1 → edge (production, region=eu, role=edge)".
+func (c Config) identity() string {
+	var details []string
+	if c.Environment != "" {
+		details = append(details, c.Environment)
+	}
+	for _, key := range sortedKeys(c.HostLabels) {
+		details = append(details, key+"="+c.HostLabels[key])
+	}
+	name := cmp.Or(c.HostName, "barnacle")
+	if c.Target.Name != "" {
+		name += " → " + c.Target.Name
+	}
+	if len(details) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, strings.Join(details, ", "))
+}
+
+// reloadConfig applies a freshly loaded config on top of the running one.
+// Settings that decide which repository is checked out, which directories
+// are stacks or where the API listens only take effect after a restart.
+func reloadConfig(current Config) (Config, error) {
+	next, err := loadConfig()
+	if err != nil {
+		return current, err
+	}
+
+	if next.RepoURL != current.RepoURL || next.RepoPath != current.RepoPath || next.Branch != current.Branch || next.InstanceID != current.InstanceID {
+		slog.Warn("Repository or instance settings changed, restart barnacle to apply them")
+		next.RepoURL, next.RepoPath, next.Branch, next.InstanceID = current.RepoURL, current.RepoPath, current.Branch, current.InstanceID
+	}
+	if next.APIAddr != current.APIAddr || next.StatePath != current.StatePath || next.AuditLogPath != current.AuditLogPath {
+		slog.Warn("API_ADDR, STATE_PATH or AUDIT_LOG changed, restart barnacle to apply them")
+		next.APIAddr, next.StatePath, next.AuditLogPath = current.APIAddr, current.StatePath, current.AuditLogPath
+	}
+
+	// Moving the stacks root or changing which directories count as stacks
+	// renames every stack, which a pass would take for the whole fleet being
+	// deleted and redeployed.
+	if next.StacksRoot != current.StacksRoot || next.StacksDepth != current.StacksDepth ||
+		!slices.Equal(next.StacksInclude, current.StacksInclude) || !slices.Equal(next.StacksExclude, current.StacksExclude) {
+		slog.Warn("STACKS_ROOT, STACKS_DEPTH, STACKS_INCLUDE or STACKS_EXCLUDE changed, restart barnacle to apply them")
+		next.StacksRoot, next.StacksDepth = current.StacksRoot, current.StacksDepth
+		next.StacksInclude, next.StacksExclude = current.StacksInclude, current.StacksExclude
+		next.SparseDirs = current.SparseDirs
+	}
+
+	if !slices.Equal(next.Targets, current.Targets) {
+		slog.Warn("DOCKER_TARGETS changed, restart barnacle to apply them")
+		next.Targets = current.Targets
+	}
+
+	if err := setupLogging(next); err != nil {
+		return current, err
+	}
+	shutdownTimeout = next.ShutdownTimeout
+
+	return next, nil
+}
+
+// sharedConfig lets the API server see configuration reloaded by the main loop.
+type sharedConfig struct {
+	mu     sync.RWMutex
+	config Config
+}
+
+func newSharedConfig(config Config) *sharedConfig {
+	return &sharedConfig{config: config}
+}
+
+func (c *sharedConfig) get() Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config
+}
+
+func (c *sharedConfig) set(config Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = config
+}
+
+func extractRepoName(repoURL string) string {
+	repoURL = strings.TrimSuffix(repoURL, ".git")
+
+	if strings.Contains(repoURL, ":") && strings.Contains(repoURL, "@") {
+		parts := strings.Split(repoURL, ":")
+		if len(parts) >= 2 {
+			path := parts[len(parts)-1]
+			return filepath.Base(path)
+		}
+	}
+
+	return filepath.Base(repoURL)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigFilePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(path, []byte("branch: production\nshutdown_timeout: 30s\n"), 0644))
+
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("REPO_URL", "git@github.com:user/stacks.git")
+	t.Setenv("BRANCH", "main")
+	t.Setenv("LOG_LEVEL", "debug")
+
+	config, err := loadConfig()
+	require.NoError(t, err)
+
+	assert.Equal(t, "production", config.Branch)
+	assert.Equal(t, "debug", config.LogLevel)
+	assert.Equal(t, 30*time.Second, config.ShutdownTimeout)
+	assert.Equal(t, "/opt/stacks", config.RepoPath)
+	assert.Empty(t, config.HostName, "the container's hostname is not a useful default")
+}
+
+func TestReloadKeepsStackDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("REPO_URL", "git@github.com:user/stacks.git")
+
+	require.NoError(t, os.WriteFile(path, []byte("stacks_root: stacks\n"), 0644))
+	current, err := loadConfig()
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("stacks_root: deploy\nstacks_depth: 2\nstacks_exclude: old/*\ndiscord_webhook: https://example.com/hook\n"), 0644))
+	next, err := reloadConfig(current)
+	require.NoError(t, err)
+
+	assert.Equal(t, "stacks", next.StacksRoot)
+	assert.Equal(t, 1, next.StacksDepth)
+	assert.Empty(t, next.StacksExclude)
+	assert.Equal(t, "https://example.com/hook", next.DiscordWebhook, "other settings still reload")
+}
+
+func TestParseHostLabels(t *testing.T) {
+	labels, err := parseHostLabels("role=edge, region = eu,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"role": "edge", "region": "eu"}, labels)
+
+	_, err = parseHostLabels("edge")
+	assert.Error(t, err)
+
+	config := Config{HostName: "web-1", Environment: "production", HostLabels: labels}
+	assert.Equal(t, "web-1 (production, region=eu, role=edge)", config.identity())
+	assert.Equal(t, "web-1", Config{HostName: "web-1"}.identity())
+	assert.Equal(t, "web-1 → edge", Config{HostName: "web-1", Target: dockerTarget{Name: "edge"}}.identity())
+	assert.Equal(t, "barnacle → edge", Config{Target: dockerTarget{Name: "edge"}}.identity())
+}
+
+func TestAPIAddrNeedsTokenBeyondLocalhost(t *testing.T) {
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yml"))
+	t.Setenv("REPO_URL", "git@github.com:user/stacks.git")
+
+	tests := []struct {
+		addr      string
+		token     string
+		expectErr bool
+	}{
+		{addr: "127.0.0.1:8080"},
+		{addr: "localhost:9000"},
+		{addr: "[::1]:8080"},
+		{addr: ""},
+		{addr: "off"},
+		{addr: ":8080", expectErr: true},
+		{addr: "0.0.0.0:8080", expectErr: true},
+		{addr: ":8080", token: "secret"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.addr, func(t *testing.T) {
+			t.Setenv("API_ADDR", tc.addr)
+			t.Setenv("API_TOKEN", tc.token)
+			config, err := loadConfig()
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			switch tc.addr {
+			case "":
+				assert.Equal(t, defaultAPIAddr, config.APIAddr)
+			case "off":
+				assert.Empty(t, config.APIAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNoPendingDeletion = errors.New("no stack removal is waiting for confirmation")
+
+// deleteThreshold caps how many stacks a single pass may remove before the
+// removal is held for confirmation. It is either an absolute count or a
+// percentage of the deployed stacks.
+type deleteThreshold struct {
+	value   int
+	percent bool
+	off     bool
+}
+
+// PendingDeletion is a removal that exceeded DELETE_THRESHOLD and is waiting
+// for confirmation through the API or CLI.
+type PendingDeletion struct {
+	Stacks []string  `json:"stacks"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason"`
+}
+
+func parseDeleteThreshold(value string) (deleteThreshold, error) {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(value, "off") {
+		return deleteThreshold{off: true}, nil
+	}
+
+	number, percent := strings.CutSuffix(value, "%")
+	n, err := strconv.Atoi(strings.TrimSpace(number))
+	if err != nil || n < 0 || (percent && n > 100) {
+		return deleteThreshold{}, fmt.Errorf("invalid DELETE_THRESHOLD %q: want a count, a percentage or off", value)
+	}
+	return deleteThreshold{value: n, percent: percent}, nil
+}
+
+func (t deleteThreshold) String() string {
+	switch {
+	case t.off:
+		return "off"
+	case t.percent:
+		return strconv.Itoa(t.value) + "%"
+	}
+	return strconv.Itoa(t.value)
+}
+
+// exceeds reports whether removing deleting of deployed stacks needs
+// confirmation. A percentage never holds back a single removal, otherwise
+// deleting the only stack of a small repo would always need confirming.
+func (t deleteThreshold) exceeds(deleting, deployed int) bool {
+	switch {
+	case t.off:
+		return false
+	case t.percent:
+		return deleting > 1 && deleting*100 > t.value*deployed
+	}
+	return deleting > t.value
+}
+
+// removeDeletedStacks applies the deletion policy of stacks that disappeared
+// from the repo. Tearing stacks down is refused when the state is not
+// trustworthy enough and held when too many would go at once. Stacks that are
+// refused, held, failed to come down or were not reached before shutdown are
+// returned so they stay in the inventory and are retried on the next pass.
+func removeDeletedStacks(ctx context.Context, config Config, deletedStacks []string, state *State, results map[string]error) []string {
+	if len(deletedStacks) == 0 {
+		return nil
+	}
+
+	if reason := state.cleanupBlocked(); reason != "" {
+		slog.Error("Refusing to remove deleted stacks", "phase", "cleanup", "stacks", deletedStacks, "reason", reason)
+		for _, stackName := range deletedStacks {
+			results[stackName+resultDeleted] = fmt.Errorf("removal refused: %s", reason)
+		}
+		return deletedStacks
+	}
+
+	// Only stacks that would be downed count towards the threshold. While a
+	// removal is held, anything else that disappears joins it rather than
+	// slipping through under the threshold on its own.
+	var downed, spared []string
+	for _, stackName := range deletedStacks {
+		switch deletePolicyFor(config, state, stackName) {
+		case deletePolicyKeep, deletePolicyOrphan:
+			spared = append(spared, stackName)
+		default:
+			downed = append(downed, stackName)
+		}
+	}
+	remaining := cleanupDeletedStacks(ctx, config, state, spared, results)
+
+	held := state.pendingDeletionStacks()
+	for _, stackName := range downed {
+		held[stackName] = true
+	}
+
+	deployed := len(state.DeployedStacks)
+	if len(downed) == 0 || !config.DeleteThreshold.exceeds(len(held), deployed) {
+		remaining = append(remaining, cleanupDeletedStacks(ctx, config, state, downed, results)...)
+		for _, stackName := range downed {
+			state.unholdDeletion(stackName)
+		}
+		return remaining
+	}
+
+	reason := fmt.Sprintf("%d of %d deployed stacks would be removed, above DELETE_THRESHOLD %s", len(held), deployed, config.DeleteThreshold)
+	slog.Error("Holding stack removal for confirmation", "phase", "cleanup", "stacks", sortedKeys(held), "reason", reason)
+	for _, stackName := range downed {
+		results[stackName+resultDeleted] = fmt.Errorf("removal held: %s", reason)
+	}
+
+	if state.holdDeletion(sortedKeys(held), reason) {
+		sendAlertWebhook(config.DiscordWebhook, "Stack removal held",
+			reason+". Run `barnacle confirm-deletion` to remove them.",
+			strings.Join(sortedKeys(held), ", "))
+	}
+	return append(remaining, downed...)
+}
+
+// cleanupDeletedStacks applies each stack's deletion policy. Kept and orphaned
+// stacks are reported once and then leave the inventory; their status stays
+// in the state. It returns the stacks it did not remove, because compose down
+// failed or shutdown came first.
+func cleanupDeletedStacks(ctx context.Context, config Config, state *State, deletedStacks []string, results map[string]error) []string {
+	var remaining []string
+	for i, stackName := range deletedStacks {
+		if ctx.Err() != nil {
+			slog.Warn("Shutdown requested, skipping remaining deleted stacks", "phase", "cleanup", "stacks", deletedStacks[i:])
+			return append(remaining, deletedStacks[i:]...)
+		}
+
+		policy := deletePolicyFor(config, state, stackName)
+		switch policy {
+		case deletePolicyKeep:
+			slog.Info("Stack was deleted but is protected, leaving it running", "stack", stackName, "phase", "cleanup")
+			results[stackName+resultKept] = nil
+			continue
+		case deletePolicyOrphan:
+			slog.Info("Stack was deleted, no longer managing it but leaving it running", "stack", stackName, "phase", "cleanup")
+			results[stackName+resultOrphaned] = nil
+			continue
+		}
+
+		stackPath := filepath.Join(config.stacksPath(), stackName)
+		slog.Info("Stack was deleted, running docker compose down", "stack", stackName, "phase", "cleanup", "policy", policy)
+
+		// A stack marked for removal still has its manifest; a deleted one
+		// is downed by project name alone.
+		manifest, _ := loadStackManifest(stackPath)
+		project := newComposeProject(config, stackName, stackPath, state.stackProject(stackName), manifest)
+		err := dockerComposeDown(ctx, project, policy == deletePolicyDownVolumes)
+		appMetrics.observeStackRemoval(config.Target.displayName(), stackName, err)
+		if err != nil {
+			slog.Warn("Failed to stop deleted stack", "stack", stackName, "phase", "cleanup", "error", err)
+			results[stackName+resultDeleted] = err
+			remaining = append(remaining, stackName)
+		} else {
+			slog.Info("Successfully stopped deleted stack", "stack", stackName, "phase", "cleanup")
+			results[stackName+resultDeleted] = nil
+		}
+	}
+	return remaining
+}
+
+// deletePolicyFor decides what happens to a stack that left the repo. The
+// host's STACK_DELETE_POLICIES win over the stack's own manifest, which wins
+// over DELETE_POLICY. A stack explicitly marked for removal is always torn
+// down, with its volumes if the policy asks for that.
+func deletePolicyFor(config Config, state *State, stackName string) string {
+	policy := config.StackDeletePolicies[stackName]
+	if policy == "" {
+		policy = cmp.Or(state.deletePolicy(stackName), config.DeletePolicy)
+	}
+	if policy != deletePolicyDownVolumes && stackMode(filepath.Join(config.stacksPath(), stackName)) == stackModeRemove {
+		return deletePolicyDown
+	}
+	return policy
+}
+
+// parseStackDeletePolicies reads STACK_DELETE_POLICIES, a comma separated
+// list such as "db=keep,cache=down-volumes".
+func parseStackDeletePolicies(value string) (map[string]string, error) {
+	policies := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		stackName, policy, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(stackName) == "" {
+			return nil, fmt.Errorf("invalid STACK_DELETE_POLICIES entry %q: want stack=policy", entry)
+		}
+		policy, err := parseDeletePolicy(strings.TrimSpace(policy))
+		if err != nil {
+			return nil, fmt.Errorf("STACK_DELETE_POLICIES: %w", err)
+		}
+		policies[strings.TrimSpace(stackName)] = policy
+	}
+	return policies, nil
+}
+
+// releaseDeletion drops held stacks that are back in the repo, so a fixed
+// checkout cancels the removal without anyone confirming it.
+func releaseDeletion(state *State, currentStacks map[string]bool) {
+	for stackName := range state.pendingDeletionStacks() {
+		if currentStacks[stackName] {
+			state.unholdDeletion(stackName)
+		}
+	}
+}
+
+// confirmDeletion removes the held stacks that are still missing from the repo,
+// on every target that has a removal held.
+func (r *reconciler) confirmDeletion(ctx context.Context) triggerResult {
+	results := make(map[string]error)
+	confirmed := false
+	for _, t := range r.targets {
+		held := t.state.pendingDeletionStacks()
+		if len(held) == 0 {
+			continue
+		}
+		confirmed = true
+
+		config := r.config.forTarget(t.docker)
+		currentStacks, suspendedStacks, brokenStacks, err := getCurrentStacks(config)
+		if err != nil {
+			return triggerResult{results: results, err: err}
+		}
+
+		deletedStacks := []string{}
+		for stackName := range held {
+			if !currentStacks[stackName] && !suspendedStacks[stackName] && brokenStacks[stackName] == nil {
+				deletedStacks = append(deletedStacks, stackName)
+			}
+		}
+		sort.Strings(deletedStacks)
+
+		slog.Info("Stack removal confirmed", "phase", "cleanup", "target", t.docker.displayName(), "stacks", deletedStacks)
+
+		targetResults := make(map[string]error)
+		cleanupDeletedStacks(ctx, config, t.state, deletedStacks, targetResults)
+		settleConfirmedDeletion(t.state, deletedStacks, targetResults)
+		r.finishTarget(t, targetResults, nil, true, results)
+	}
+
+	if !confirmed {
+		return triggerResult{err: errNoPendingDeletion}
+	}
+	return triggerResult{results: results}
+}
+
+// settleConfirmedDeletion forgets the confirmed stacks that were removed, kept
+// or orphaned and releases them from the held removal, along with any that are
+// back in the repo. A stack whose removal failed, or that shutdown
+// kept from being reached, stays deployed and held so that confirming again
+// retries it.
+func settleConfirmedDeletion(state *State, deletedStacks []string, results map[string]error) {
+	var gone []string
+	for _, stackName := range deletedStacks {
+		_, orphaned := results[stackName+resultOrphaned]
+		_, kept := results[stackName+resultKept]
+		if err, ok := results[stackName+resultDeleted]; (!ok || err != nil) && !orphaned && !kept {
+			continue
+		}
+		gone = append(gone, stackName)
+		state.unholdDeletion(stackName)
+	}
+	state.forgetStacks(gone)
+
+	for stackName := range state.pendingDeletionStacks() {
+		if !slices.Contains(deletedStacks, stackName) {
+			state.unholdDeletion(stackName)
+		}
+	}
+}
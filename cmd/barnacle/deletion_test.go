@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		deleting  int
+		deployed  int
+		exceeded  bool
+		expectErr bool
+	}{
+		{name: "percentage below", value: "50%", deleting: 2, deployed: 10, exceeded: false},
+		{name: "percentage at limit", value: "50%", deleting: 5, deployed: 10, exceeded: false},
+		{name: "percentage above", value: "50%", deleting: 6, deployed: 10, exceeded: true},
+		{name: "percentage ignores single removal", value: "10%", deleting: 1, deployed: 1, exceeded: false},
+		{name: "count at limit", value: "3", deleting: 3, deployed: 10, exceeded: false},
+		{name: "count above", value: "3", deleting: 4, deployed: 10, exceeded: true},
+		{name: "zero holds every removal", value: "0", deleting: 1, deployed: 10, exceeded: true},
+		{name: "off", value: "off", deleting: 10, deployed: 10, exceeded: false},
+		{name: "not a number", value: "many", expectErr: true},
+		{name: "negative", value: "-1", expectErr: true},
+		{name: "percentage over 100", value: "150%", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			threshold, err := parseDeleteThreshold(tc.value)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.value, threshold.String())
+			assert.Equal(t, tc.exceeded, threshold.exceeds(tc.deleting, tc.deployed))
+		})
+	}
+}
+
+func TestRemoveDeletedStacksHoldsMassDeletion(t *testing.T) {
+	threshold, err := parseDeleteThreshold("1")
+	require.NoError(t, err)
+	config := Config{RepoPath: t.TempDir(), DeleteThreshold: threshold}
+
+	state := newState()
+	state.setDeployedStacks(map[string]bool{"web": true, "db": true, "cache": true})
+
+	results := make(map[string]error)
+	retained := removeDeletedStacks(context.Background(), config, []string{"db", "web"}, state, results)
+
+	assert.ElementsMatch(t, []string{"db", "web"}, retained)
+	assert.ErrorContains(t, results["web (deleted)"], "removal held")
+
+	pending := state.pendingDeletion()
+	require.NotNil(t, pending)
+	assert.Equal(t, []string{"db", "web"}, pending.Stacks)
+
+	// Restoring one stack shrinks the held removal; restoring both cancels it.
+	releaseDeletion(state, map[string]bool{"web": true, "cache": true})
+	assert.Equal(t, []string{"db"}, state.pendingDeletion().Stacks)
+
+	releaseDeletion(state, map[string]bool{"web": true, "db": true, "cache": true})
+	assert.Nil(t, state.pendingDeletion())
+}
+
+func TestRemoveDeletedStacksPolicies(t *testing.T) {
+	threshold, err := parseDeleteThreshold("off")
+	require.NoError(t, err)
+	config := Config{
+		RepoPath:            t.TempDir(),
+		DeleteThreshold:     threshold,
+		DeletePolicy:        deletePolicyDown,
+		StackDeletePolicies: map[string]string{"db": deletePolicyKeep},
+	}
+
+	state := newState()
+	state.setDeployedStacks(map[string]bool{"db": true, "metrics": true, "web": true})
+	state.recordManifest("metrics", stackManifest{OnDelete: deletePolicyOrphan})
+	// The host's config wins over what the stack's manifest asked for.
+	state.recordManifest("db", stackManifest{OnDelete: deletePolicyDownVolumes})
+
+	results := make(map[string]error)
+	retained := removeDeletedStacks(context.Background(), config, []string{"db", "metrics"}, state, results)
+
+	assert.Empty(t, retained, "kept stacks leave the inventory once reported")
+	assert.Equal(t, map[string]error{"db (kept)": nil, "metrics (orphaned)": nil}, results)
+
+	state.recordDeployment("abc123", results)
+	db, _ := state.stackStatus("db")
+	assert.Equal(t, stackStatusKept, db.Status)
+	metrics, _ := state.stackStatus("metrics")
+	assert.Equal(t, stackStatusOrphaned, metrics.Status)
+}
+
+func TestRemoveDeletedStacksRetainsUnremoved(t *testing.T) {
+	// Compose down fails for db and succeeds for everything else.
+	binDir := t.TempDir()
+	script := "#!/bin/sh\ncase \"$*\" in *\"-p db \"*) exit 1 ;; esac\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "docker"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	threshold, err := parseDeleteThreshold("off")
+	require.NoError(t, err)
+	config := Config{RepoPath: t.TempDir(), DeleteThreshold: threshold, DeletePolicy: deletePolicyDown}
+
+	state := newState()
+	state.setDeployedStacks(map[string]bool{"db": true, "web": true, "cache": true})
+	for _, stackName := range []string{"db", "web", "cache"} {
+		state.recordManifest(stackName, stackManifest{Project: stackName})
+	}
+
+	results := make(map[string]error)
+	retained := removeDeletedStacks(context.Background(), config, []string{"db", "web"}, state, results)
+	assert.Equal(t, []string{"db"}, retained, "a failed removal is retried")
+	assert.Error(t, results["db (deleted)"])
+	assert.NoError(t, results["web (deleted)"])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = make(map[string]error)
+	retained = removeDeletedStacks(ctx, config, []string{"cache", "db"}, state, results)
+	assert.Equal(t, []string{"cache", "db"}, retained, "stacks shutdown kept from being removed stay")
+	assert.Empty(t, results)
+}
+
+func TestRemoveMarkerWinsOverDeletePolicy(t *testing.T) {
+	config := Config{
+		RepoPath:            t.TempDir(),
+		DeletePolicy:        deletePolicyDown,
+		StackDeletePolicies: map[string]string{"cache": deletePolicyDownVolumes},
+	}
+	for _, stackName := range []string{"db", "cache", "metrics"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(config.RepoPath, stackName), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(config.RepoPath, stackName, "remove"), nil, 0644))
+	}
+
+	state := newState()
+	state.recordManifest("db", stackManifest{OnDelete: deletePolicyKeep})
+	state.recordManifest("logs", stackManifest{OnDelete: deletePolicyKeep})
+
+	assert.Equal(t, deletePolicyDown, deletePolicyFor(config, state, "db"))
+	assert.Equal(t, deletePolicyDownVolumes, deletePolicyFor(config, state, "cache"))
+	assert.Equal(t, deletePolicyDown, deletePolicyFor(config, state, "metrics"))
+	// Without the marker the stack is simply gone and its policy holds.
+	assert.Equal(t, deletePolicyKeep, deletePolicyFor(config, state, "logs"))
+}
+
+func TestSettleConfirmedDeletion(t *testing.T) {
+	state := newState()
+	state.setDeployedStacks(map[string]bool{"web": true, "db": true, "cache": true, "logs": true, "queue": true})
+	state.holdDeletion([]string{"cache", "db", "logs", "queue", "web"}, "above threshold")
+
+	// queue is back in the repo, and shutdown came before logs was reached.
+	results := map[string]error{
+		"web (deleted)": nil,
+		"db (deleted)":  errors.New("boom"),
+		"cache (kept)":  nil,
+	}
+	settleConfirmedDeletion(state, []string{"cache", "db", "logs", "web"}, results)
+
+	assert.Equal(t, map[string]bool{"db": true, "logs": true, "queue": true}, state.DeployedStacks)
+	require.NotNil(t, state.pendingDeletion())
+	assert.Equal(t, []string{"db", "logs"}, state.pendingDeletion().Stacks)
+}
+
+func TestParseStackDeletePolicies(t *testing.T) {
+	policies, err := parseStackDeletePolicies(" db=keep, cache=down-volumes ,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"db": deletePolicyKeep, "cache": deletePolicyDownVolumes}, policies)
+
+	_, err = parseStackDeletePolicies("db")
+	assert.Error(t, err)
+	_, err = parseStackDeletePolicies("db=destroy")
+	assert.Error(t, err)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stackDependencies maps each stack to the repo-relative paths outside its
+// own directory that it reads: env files, bind mounts, build contexts,
+// configs, secrets, extended or included compose files, and the env files and
+// extra watch paths from its manifest. The compose files scanned are the ones
+// the stack is deployed with, overlays included, and any they extend or
+// include. A change under any of the paths redeploys the stack.
+func stackDependencies(config Config, stacks map[string]bool) map[string][]string {
+	dependencies := make(map[string][]string)
+	for stackName := range stacks {
+		stackPath := filepath.Join(config.stacksPath(), stackName)
+		stackDir := path.Join(config.StacksRoot, stackName)
+		manifest, manifestErr := loadStackManifest(stackPath)
+
+		// Paths are kept relative to the repo root from here on, since each
+		// compose file's references are relative to that file.
+		var refs, queue []string
+		for _, file := range newComposeProject(config, stackName, stackPath, "", manifest).files {
+			queue = append(queue, path.Join(stackDir, filepath.ToSlash(file)))
+		}
+		scanned := make(map[string]bool)
+		for len(queue) > 0 {
+			file := queue[0]
+			queue = queue[1:]
+			if scanned[file] || !insideRepo(file) {
+				continue
+			}
+			scanned[file] = true
+
+			fileRefs, included, err := composeFileReferences(filepath.Join(config.RepoPath, filepath.FromSlash(file)))
+			if err != nil {
+				slog.Warn("Failed to read compose file for shared dependencies", "stack", stackName, "file", file, "error", err)
+				continue
+			}
+			refs = append(refs, resolveReferences(path.Dir(file), fileRefs)...)
+			queue = append(queue, resolveReferences(path.Dir(file), included)...)
+		}
+		if manifestErr == nil {
+			refs = append(refs, resolveReferences(stackDir, manifest.EnvFiles)...)
+			refs = append(refs, resolveReferences(stackDir, manifest.Watch)...)
+		}
+
+		seen := make(map[string]bool)
+		for _, dependency := range refs {
+			if !insideRepo(dependency) {
+				continue
+			}
+			if dependency == stackDir || strings.HasPrefix(dependency, stackDir+"/") {
+				continue
+			}
+			if !seen[dependency] {
+				seen[dependency] = true
+				dependencies[stackName] = append(dependencies[stackName], dependency)
+			}
+		}
+		sort.Strings(dependencies[stackName])
+	}
+	return dependencies
+}
+
+// resolveReferences joins the paths a file refers to onto the directory they
+// are relative to. Interpolated, absolute and remote paths point outside the
+// repo and are dropped.
+func resolveReferences(dir string, refs []string) []string {
+	var resolved []string
+	for _, ref := range refs {
+		if ref == "" || strings.Contains(ref, "$") || path.IsAbs(ref) || strings.HasPrefix(ref, "~") || strings.Contains(ref, "://") {
+			continue
+		}
+		resolved = append(resolved, path.Join(dir, ref))
+	}
+	return resolved
+}
+
+func insideRepo(file string) bool {
+	return file != ".." && !strings.HasPrefix(file, "../")
+}
+
+// dependentStacks returns the stacks with a dependency on any of the changed
+// files, which are relative to the repo root.
+func dependentStacks(changedFiles []string, dependencies map[string][]string) map[string]bool {
+	stacks := make(map[string]bool)
+	for _, file := range changedFiles {
+		file = path.Clean(file)
+		for stackName, paths := range dependencies {
+			for _, dependency := range paths {
+				if file == dependency || strings.HasPrefix(file, dependency+"/") {
+					slog.Info("Shared file changed", "stack", stackName, "path", file)
+					stacks[stackName] = true
+					break
+				}
+			}
+		}
+	}
+	return stacks
+}
+
+// composeFileReferences lists the paths a compose file refers to, relative to
+// the file's directory as compose resolves them, and separately the compose
+// files among them that it extends or includes, whose own paths are relative
+// to where they are.
+func composeFileReferences(composePath string) ([]string, []string, error) {
+	data, err := os.ReadFile(composePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var compose struct {
+		Services map[string]struct {
+			EnvFile any   `yaml:"env_file"`
+			Volumes []any `yaml:"volumes"`
+			Build   any   `yaml:"build"`
+			Extends any   `yaml:"extends"`
+		} `yaml:"services"`
+		Configs map[string]struct {
+			File string `yaml:"file"`
+		} `yaml:"configs"`
+		Secrets map[string]struct {
+			File string `yaml:"file"`
+		} `yaml:"secrets"`
+		Include []any `yaml:"include"`
+	}
+	if err := yaml.Unmarshal(data, &compose); err != nil {
+		return nil, nil, err
+	}
+
+	var refs, included []string
+	for _, service := range compose.Services {
+		refs = append(refs, pathsFrom(service.EnvFile, "path")...)
+		refs = append(refs, pathsFrom(service.Build, "context")...)
+		included = append(included, pathsFrom(service.Extends, "file")...)
+
+		for _, volume := range service.Volumes {
+			switch v := volume.(type) {
+			case string:
+				// Only sources that look like paths are bind mounts; anything
+				// else is a named volume.
+				source, _, _ := strings.Cut(v, ":")
+				if strings.HasPrefix(source, ".") {
+					refs = append(refs, source)
+				}
+			case map[string]any:
+				if v["type"] == "bind" {
+					refs = append(refs, pathsFrom(v, "source")...)
+				}
+			}
+		}
+	}
+	for _, config := range compose.Configs {
+		refs = append(refs, config.File)
+	}
+	for _, secret := range compose.Secrets {
+		refs = append(refs, secret.File)
+	}
+	for _, include := range compose.Include {
+		included = append(included, pathsFrom(include, "path")...)
+	}
+	return append(refs, included...), included, nil
+}
+
+// pathsFrom reads the compose short and long forms of a path setting: a
+// string, a mapping with the path under key, or a list of either.
+func pathsFrom(value any, key string) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case map[string]any:
+		return pathsFrom(v[key], key)
+	case []any:
+		var paths []string
+		for _, item := range v {
+			paths = append(paths, pathsFrom(item, key)...)
+		}
+		return paths
+	}
+	return nil
+}
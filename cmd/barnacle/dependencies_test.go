@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStackDependencies(t *testing.T) {
+	repoPath := t.TempDir()
+	files := map[string]string{
+		"stacks/web/compose.yml": `
+services:
+  web:
+    build: ../../images/web
+    env_file: ../../common/.env
+    volumes:
+      - ./data:/data
+      - ../../configs/nginx:/etc/nginx:ro
+      - named:/cache
+      - /srv/media:/media
+      - type: bind
+        source: ../../certs
+        target: /certs
+  worker:
+    env_file:
+      - path: ../../common/worker.env
+      - ${ENV_FILE}
+configs:
+  app:
+    file: ../../configs/app.yml
+secrets:
+  token:
+    file: ./secrets/token
+`,
+		"stacks/web/" + manifestFileName: "env_files: [../../common/prod.env]\nwatch:\n  - ../../scripts/migrate.sh\n  - ../../../outside\n",
+		"stacks/db/compose.yml":          "services:\n  db:\n    image: postgres\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(repoPath, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(repoPath, name), []byte(content), 0644))
+	}
+
+	config := Config{RepoPath: repoPath, StacksRoot: "stacks"}
+	dependencies := stackDependencies(config, map[string]bool{"web": true, "db": true})
+
+	assert.Equal(t, []string{
+		"certs",
+		"common/.env",
+		"common/prod.env",
+		"common/worker.env",
+		"configs/app.yml",
+		"configs/nginx",
+		"images/web",
+		"scripts/migrate.sh",
+	}, dependencies["web"])
+	assert.Empty(t, dependencies["db"])
+
+	assert.Equal(t, map[string]bool{"web": true},
+		dependentStacks([]string{"configs/nginx/default.conf", "README.md"}, dependencies))
+	assert.Empty(t, dependentStacks([]string{"configs/nginx-old.conf"}, dependencies))
+}
+
+func TestStackDependenciesFollowOverlaysAndIncludes(t *testing.T) {
+	repoPath := t.TempDir()
+	files := map[string]string{
+		"stacks/web/compose.yml": "include:\n  - ../../shared/monitoring.yml\nservices:\n  web:\n    image: nginx\n",
+		// Overlays and included files resolve paths from where they are.
+		"stacks/web/overlays/production/compose.yml": "services:\n  web:\n    env_file: ../../../../common/prod.env\n",
+		"stacks/web/overlays/staging/compose.yml":    "services:\n  web:\n    env_file: ../../../../common/staging.env\n",
+		"shared/monitoring.yml":                      "services:\n  exporter:\n    extends:\n      file: base/exporter.yml\n      service: exporter\n    env_file: ./exporter.env\n",
+		"shared/base/exporter.yml":                   "services:\n  exporter:\n    volumes:\n      - ./exporter.conf:/etc/exporter.conf\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(repoPath, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(repoPath, name), []byte(content), 0644))
+	}
+
+	config := Config{RepoPath: repoPath, StacksRoot: "stacks", Environment: "production"}
+	dependencies := stackDependencies(config, map[string]bool{"web": true})
+
+	assert.Equal(t, []string{
+		"common/prod.env",
+		"shared/base/exporter.conf",
+		"shared/base/exporter.yml",
+		"shared/exporter.env",
+		"shared/monitoring.yml",
+	}, dependencies["web"])
+}
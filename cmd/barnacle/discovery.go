@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// stacksPath is the directory stacks are discovered under. Stack names are
+// paths relative to it, such as web or prod/web.
+func (c Config) stacksPath() string {
+	return filepath.Join(c.RepoPath, c.StacksRoot)
+}
+
+// stackRelativePath turns a path relative to the repo root into one relative
+// to STACKS_ROOT. Paths outside the stacks root come back as "".
+func (c Config) stackRelativePath(file string) string {
+	if c.StacksRoot == "" {
+		return file
+	}
+	rel, ok := strings.CutPrefix(path.Clean(file), c.StacksRoot+"/")
+	if !ok {
+		return ""
+	}
+	return rel
+}
+
+func (c Config) stackRelativePaths(files []string) []string {
+	if c.StacksRoot == "" {
+		return files
+	}
+	relFiles := []string{}
+	for _, file := range files {
+		if rel := c.stackRelativePath(file); rel != "" {
+			relFiles = append(relFiles, rel)
+		}
+	}
+	return relFiles
+}
+
+func (c Config) stackSelected(stackName string) bool {
+	for _, pattern := range c.StacksExclude {
+		if matched, _ := path.Match(pattern, stackName); matched {
+			return false
+		}
+	}
+	if len(c.StacksInclude) == 0 {
+		return true
+	}
+	for _, pattern := range c.StacksInclude {
+		if matched, _ := path.Match(pattern, stackName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// getCurrentStacks lists the stacks on disk that barnacle manages, and
+// separately the ones that are suspended and must be left as they are, and
+// the ones that cannot be deployed until they are fixed, with the reason. Any
+// directory with a compose file up to STACKS_DEPTH levels below the stacks
+// root is a stack, including directories inside another stack.
+func getCurrentStacks(config Config) (map[string]bool, map[string]bool, map[string]error, error) {
+	currentStacks := make(map[string]bool)
+	suspendedStacks := make(map[string]bool)
+	brokenStacks := make(map[string]error)
+
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		entries, err := os.ReadDir(filepath.Join(config.stacksPath(), dir))
+		if err != nil {
+			return fmt.Errorf("failed to read stacks directory: %w", err)
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() || entry.Name()[0] == '.' {
+				continue
+			}
+
+			stackName := path.Join(dir, entry.Name())
+			stackPath := filepath.Join(config.stacksPath(), stackName)
+
+			// A stack's overlays hold compose files too, but are not stacks.
+			if entry.Name() == overlaysDirName && hasComposeFile(filepath.Join(config.stacksPath(), dir)) {
+				continue
+			}
+
+			if depth < max(config.StacksDepth, 1) {
+				if err := walk(stackName, depth+1); err != nil {
+					return err
+				}
+			}
+
+			if !hasComposeFile(stackPath) {
+				slog.Debug("Skipping directory: no compose file found", "stack", stackName)
+				continue
+			}
+			if !config.stackSelected(stackName) {
+				slog.Debug("Skipping stack: not selected by STACKS_INCLUDE or STACKS_EXCLUDE", "stack", stackName)
+				continue
+			}
+
+			// Without its manifest there is no telling which hosts and
+			// targets the stack is meant for, so it goes nowhere.
+			manifest, err := loadStackManifest(stackPath)
+			if err != nil {
+				slog.Error("Skipping stack: its manifest could not be read", "stack", stackName, "error", err)
+				brokenStacks[stackName] = err
+				continue
+			}
+			if !manifest.targets(config) {
+				if config.Target.Name == "" && manifest.Target != "" && !config.hasTarget(manifest.Target) {
+					slog.Warn("Skipping stack: target is not in DOCKER_TARGETS", "stack", stackName, "target", manifest.Target)
+					continue
+				}
+				if len(manifest.Hosts) > 0 && config.HostName == "" {
+					slog.Warn("Skipping stack: it is limited to hosts but HOST_NAME is not set", "stack", stackName, "hosts", manifest.Hosts)
+					continue
+				}
+				slog.Debug("Skipping stack: not targeted at this environment, host or host labels", "stack", stackName)
+				continue
+			}
+
+			switch stackMode(stackPath) {
+			case stackModeSuspend:
+				slog.Debug("Skipping stack: suspended", "stack", stackName)
+				suspendedStacks[stackName] = true
+				continue
+			case stackModeRemove:
+				slog.Debug("Skipping stack: marked for removal", "stack", stackName)
+				continue
+			}
+
+			currentStacks[stackName] = true
+		}
+		return nil
+	}
+
+	if err := walk("", 1); err != nil {
+		return nil, nil, nil, err
+	}
+	for stackName, err := range projectCollisions(config, currentStacks, suspendedStacks) {
+		slog.Error("Skipping stack: its compose project collides with another stack", "stack", stackName, "error", err)
+		delete(currentStacks, stackName)
+		delete(suspendedStacks, stackName)
+		brokenStacks[stackName] = err
+	}
+
+	slog.Debug("Current stacks on disk", "stacks", mapKeys(currentStacks), "suspended", mapKeys(suspendedStacks), "broken", sortedKeys(brokenStacks))
+	return currentStacks, suspendedStacks, brokenStacks, nil
+}
+
+// projectCollisions finds stacks that would run as the same compose project,
+// such as prod/web and prod-web, since deploying one would replace the other's
+// containers. Every stack in a collision is returned, with the stacks it
+// collides with in the error.
+func projectCollisions(config Config, stackSets ...map[string]bool) map[string]error {
+	byProject := make(map[string][]string)
+	for _, stacks := range stackSets {
+		for stackName := range stacks {
+			project := composeProjectName(stackName)
+			if manifest, err := loadStackManifest(filepath.Join(config.stacksPath(), stackName)); err == nil && manifest.Project != "" {
+				project = manifest.Project
+			}
+			byProject[project] = append(byProject[project], stackName)
+		}
+	}
+
+	collisions := make(map[string]error)
+	for project, stackNames := range byProject {
+		if len(stackNames) < 2 {
+			continue
+		}
+		sort.Strings(stackNames)
+		err := fmt.Errorf("%s share compose project %s; give them distinct names with project: in %s", strings.Join(stackNames, " and "), project, manifestFileName)
+		for _, stackName := range stackNames {
+			collisions[stackName] = err
+		}
+	}
+	return collisions
+}
+
+// owningStack returns the deepest stack that contains file, or "" if the
+// file is not inside any of stacks.
+func owningStack(file string, stacks map[string]bool) string {
+	for dir := path.Dir(file); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if stacks[dir] {
+			return dir
+		}
+	}
+	return ""
+}
+
+func parseStackPatterns(key, value string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", key, pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCurrentStacksNested(t *testing.T) {
+	repoPath := t.TempDir()
+	for _, dir := range []string{
+		"README-only",
+		"stacks/web",
+		"stacks/prod/api",
+		"stacks/prod/api/worker",
+		"stacks/prod/db",
+		"stacks/staging/api",
+		"stacks/too/deep/stack",
+		"tools/builder",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(repoPath, dir), 0755))
+		if dir != "README-only" {
+			require.NoError(t, os.WriteFile(filepath.Join(repoPath, dir, "compose.yml"), []byte("services: {}\n"), 0644))
+		}
+	}
+
+	config := Config{
+		RepoPath:      repoPath,
+		StacksRoot:    "stacks",
+		StacksDepth:   3,
+		StacksExclude: []string{"staging/*", "too/*/*"},
+	}
+	current, _, _, err := getCurrentStacks(config)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"web": true, "prod/api": true, "prod/api/worker": true, "prod/db": true}, current)
+
+	config.StacksDepth = 1
+	current, _, _, err = getCurrentStacks(config)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"web": true}, current)
+
+	config.StacksDepth = 2
+	config.StacksInclude = []string{"prod/*"}
+	current, _, _, err = getCurrentStacks(config)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"prod/api": true, "prod/db": true}, current)
+}
+
+func TestGetCurrentStacksProjectCollision(t *testing.T) {
+	repoPath := t.TempDir()
+	for _, dir := range []string{"prod/web", "prod-web", "web"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(repoPath, dir), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(repoPath, dir, "compose.yml"), []byte("services: {}\n"), 0644))
+	}
+
+	config := Config{RepoPath: repoPath, StacksDepth: 2}
+	current, _, broken, err := getCurrentStacks(config)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"web": true}, current, "stacks that don't collide are still deployed")
+	assert.Equal(t, []string{"prod-web", "prod/web"}, sortedKeys(broken))
+	assert.EqualError(t, broken["prod/web"], "prod-web and prod/web share compose project prod-web; give them distinct names with project: in barnacle.yml")
+
+	// A colliding stack that is already deployed is left running, not
+	// taken for deleted.
+	state := newState()
+	state.setDeployedStacks(map[string]bool{"prod-web": true, "web": true})
+	results := make(map[string]error)
+	keepBrokenStacks(state, current, broken, results)
+	assert.Equal(t, map[string]bool{"prod-web": true, "web": true}, current)
+	assert.Len(t, results, 2)
+
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "prod/web", manifestFileName), []byte("project: prod-web-nested\n"), 0644))
+	current, _, broken, err = getCurrentStacks(config)
+	require.NoError(t, err)
+	assert.Empty(t, broken)
+	assert.Equal(t, map[string]bool{"prod/web": true, "prod-web": true, "web": true}, current)
+}
+
+func TestStackRelativePaths(t *testing.T) {
+	config := Config{StacksRoot: "stacks"}
+	assert.Equal(t, []string{"web/compose.yml", "prod/api/.env"},
+		config.stackRelativePaths([]string{"stacks/web/compose.yml", "README.md", "./stacks/prod/api/.env", "stacksfoo/x"}))
+
+	assert.Equal(t, []string{"README.md"}, Config{}.stackRelativePaths([]string{"README.md"}))
+}
+
+func TestOwningStack(t *testing.T) {
+	stacks := map[string]bool{"prod/api": true, "prod/api/worker": true, "web": true}
+
+	assert.Equal(t, "prod/api/worker", owningStack("prod/api/worker/compose.yml", stacks))
+	assert.Equal(t, "prod/api", owningStack("prod/api/config/app.yml", stacks))
+	assert.Equal(t, "web", owningStack("web/compose.yml", stacks))
+	assert.Equal(t, "", owningStack("prod/README.md", stacks))
+	assert.Equal(t, "", owningStack("compose.yml", stacks))
+}
+
+func TestGetCurrentStacksTargets(t *testing.T) {
+	repoPath := t.TempDir()
+	stacks := map[string]string{
+		"everywhere": "",
+		"prod-only":  "environments: [production]\n",
+		"edge-host":  "hosts: [edge-1]\n",
+		"staging":    "environments: [staging]\n",
+		"edge-role":  "selector: {role: edge, region: eu}\n",
+		"us-only":    "selector: {region: us}\n",
+		"nas":        "target: nas\n",
+		"pinned":     "target: local\n",
+	}
+	for stackName, manifest := range stacks {
+		stackPath := filepath.Join(repoPath, stackName)
+		require.NoError(t, os.MkdirAll(filepath.Join(stackPath, "overlays", "production"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(stackPath, "compose.yml"), nil, 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(stackPath, "overlays", "production", "compose.yml"), nil, 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(stackPath, manifestFileName), []byte(manifest), 0644))
+	}
+
+	config := Config{
+		RepoPath:    repoPath,
+		StacksDepth: 3,
+		Environment: "production",
+		HostName:    "web-1",
+		HostLabels:  map[string]string{"role": "edge", "region": "eu"},
+		Targets:     []dockerTarget{{Name: "nas", Host: "ssh://nas"}},
+	}
+	current, _, _, err := getCurrentStacks(config)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"everywhere": true, "prod-only": true, "edge-role": true, "pinned": true}, current)
+
+	current, _, _, err = getCurrentStacks(config.forTarget(config.Targets[0]))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"nas": true}, current)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// appHealth tracks whether the main loop is still making progress. A hung
+// compose run or webhook stops the loop from ticking, which is what /healthz
+// is meant to catch.
+var appHealth = &health{lastTick: time.Now()}
+
+type health struct {
+	mu        sync.Mutex
+	lastTick  time.Time
+	repoReady bool
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (h *health) tick() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastTick = time.Now()
+}
+
+func (h *health) setRepoReady(ready bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.repoReady = ready
+}
+
+func (h *health) checkLive(timeout time.Duration) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if since := time.Since(h.lastTick); since > timeout {
+		return fmt.Errorf("main loop has not ticked for %v", since.Round(time.Second))
+	}
+	return nil
+}
+
+func (h *health) checkReady(state *State, maxSyncAge time.Duration) error {
+	h.mu.Lock()
+	repoReady := h.repoReady
+	h.mu.Unlock()
+
+	if !repoReady {
+		return fmt.Errorf("repository not cloned yet")
+	}
+
+	state.mu.RLock()
+	lastSync := state.LastSync
+	lastError := state.LastError
+	state.mu.RUnlock()
+
+	if lastSync.IsZero() {
+		return fmt.Errorf("no successful sync yet")
+	}
+	if since := time.Since(lastSync); since > maxSyncAge {
+		if lastError != "" {
+			return fmt.Errorf("last successful sync was %v ago: %s", since.Round(time.Second), lastError)
+		}
+		return fmt.Errorf("last successful sync was %v ago", since.Round(time.Second))
+	}
+	return nil
+}
+
+func (s *apiServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, appHealth.checkLive(s.config.get().LivenessTimeout))
+}
+
+func (s *apiServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, appHealth.checkReady(s.state, s.config.get().ReadinessMaxSyncAge))
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: "unavailable", Reason: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
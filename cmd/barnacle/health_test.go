@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthChecks(t *testing.T) {
+	h := &health{lastTick: time.Now().Add(-time.Minute)}
+	assert.NoError(t, h.checkLive(5*time.Minute))
+	assert.Error(t, h.checkLive(30*time.Second))
+
+	state := newState()
+	assert.ErrorContains(t, h.checkReady(state, time.Minute), "not cloned")
+
+	h.setRepoReady(true)
+	assert.ErrorContains(t, h.checkReady(state, time.Minute), "no successful sync")
+
+	state.LastSync = time.Now().Add(-10 * time.Minute)
+	state.LastError = "failed to pull: timeout"
+	assert.ErrorContains(t, h.checkReady(state, time.Minute), "failed to pull: timeout")
+
+	state.recordSync("abc123", nil)
+	assert.NoError(t, h.checkReady(state, time.Minute))
+}
+
+func TestHealthcheckPassesWithAPIDisabled(t *testing.T) {
+	assert.Equal(t, 0, runHealthcheck(settings{"API_ADDR": "off"}))
+	assert.Error(t, callAPI(settings{"API_ADDR": "off"}, "GET", "/api/status", nil))
+}
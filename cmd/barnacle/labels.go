@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	labelInstance = "io.barnacle.instance"
+	labelRepo     = "io.barnacle.repo"
+	labelStack    = "io.barnacle.stack"
+	labelCommit   = "io.barnacle.commit"
+)
+
+// composeFileNames is the order docker compose itself uses to pick a file.
+var composeFileNames = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+// stackLabels identifies everything a barnacle instance deploys, so the
+// inventory can be rebuilt from Docker if the state file is lost. commit is
+// the commit being deployed.
+type stackLabels struct {
+	instance string
+	repo     string
+	commit   string
+}
+
+// forStack returns a stack's labels with the commit its config last changed
+// at, rather than the one being deployed. Compose recreates a container
+// whenever its labels change, so a label that moved with every commit would
+// recreate every container on each redeploy.
+func (l stackLabels) forStack(stackName, commit string) map[string]string {
+	return map[string]string{
+		labelInstance: l.instance,
+		labelRepo:     l.repo,
+		labelStack:    stackName,
+		labelCommit:   commit,
+	}
+}
+
+// composeFiles returns the files listed in the stack's manifest or else the
+// compose file docker compose would pick for the stack, followed by its
+// override file if there is one. Passing files with -f disables compose's own
+// override lookup, so it has to be done here.
+func composeFiles(stackPath string) []string {
+	if manifest, err := loadStackManifest(stackPath); err == nil && len(manifest.Files) > 0 {
+		return manifest.Files
+	}
+
+	for _, name := range composeFileNames {
+		if _, err := os.Stat(filepath.Join(stackPath, name)); err != nil {
+			continue
+		}
+
+		files := []string{name}
+		ext := filepath.Ext(name)
+		override := strings.TrimSuffix(name, ext) + ".override" + ext
+		if _, err := os.Stat(filepath.Join(stackPath, override)); err == nil {
+			files = append(files, override)
+		}
+		return files
+	}
+	return nil
+}
+
+// writeLabelOverride writes a compose override that adds labels to every
+// service in the stack and returns its path. The caller removes it.
+func writeLabelOverride(ctx context.Context, project composeProject, labels map[string]string) (string, error) {
+	services, err := composeServices(ctx, project)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := labelOverride(services, labels)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", "barnacle-override-*.yml")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func labelOverride(services []string, labels map[string]string) ([]byte, error) {
+	overrides := make(map[string]any, len(services))
+	for _, service := range services {
+		overrides[service] = map[string]any{"labels": labels}
+	}
+	return yaml.Marshal(map[string]any{"services": overrides})
+}
+
+func composeServices(ctx context.Context, project composeProject) ([]string, error) {
+	args := append(project.args(), "config", "--services")
+
+	var stdout, stderr bytes.Buffer
+	cmd := project.command(ctx, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to list services: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	services := strings.Fields(stdout.String())
+	sort.Strings(services)
+	return services, nil
+}
+
+// recoverDeployedStacks lists the stacks this instance has containers for,
+// running or not, by their barnacle labels.
+func recoverDeployedStacks(ctx context.Context, config Config) (map[string]bool, error) {
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	rt := config.runtime()
+	cmd := rt.command(cmdCtx, "ps", "-a",
+		"--filter", "label="+labelInstance+"="+config.InstanceID,
+		"--filter", "label="+labelRepo+"="+config.RepoURL,
+		"--format", fmt.Sprintf(rt.labelFormat, labelStack))
+	cmd.Env = config.Target.env()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s ps failed: %w: %s", rt.binary, err, strings.TrimSpace(stderr.String()))
+	}
+
+	stacks := make(map[string]bool)
+	for _, stackName := range strings.Fields(stdout.String()) {
+		stacks[stackName] = true
+	}
+	return stacks, nil
+}
+
+// recoverStateFromLabels rebuilds an empty inventory from Docker. It is only
+// used when the state has no deployed stacks, which is the case after the
+// state file was lost or could not be loaded.
+func recoverStateFromLabels(ctx context.Context, config Config, state *State) {
+	if len(state.DeployedStacks) > 0 {
+		return
+	}
+
+	stacks, err := recoverDeployedStacks(ctx, config)
+	if err != nil {
+		slog.Warn("Failed to recover deployed stacks from Docker labels", "target", config.Target.displayName(), "error", err)
+		return
+	}
+	if len(stacks) == 0 {
+		return
+	}
+
+	slog.Info("Recovered deployed stacks from Docker labels", "target", config.Target.displayName(), "stacks", mapKeys(stacks))
+	state.recoverInventory(stacks)
+	saveStateOrWarn(state)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestComposeFiles(t *testing.T) {
+	testCases := []struct {
+		name     string
+		files    []string
+		expected []string
+	}{
+		{name: "No compose file", files: []string{"README.md"}, expected: nil},
+		{name: "Single file", files: []string{"docker-compose.yml"}, expected: []string{"docker-compose.yml"}},
+		{name: "Preferred name wins", files: []string{"docker-compose.yml", "compose.yaml"}, expected: []string{"compose.yaml"}},
+		{
+			name:     "Override is included",
+			files:    []string{"compose.yml", "compose.override.yml"},
+			expected: []string{"compose.yml", "compose.override.yml"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, file := range tc.files {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, file), nil, 0644))
+			}
+			assert.Equal(t, tc.expected, composeFiles(dir))
+		})
+	}
+}
+
+func TestLabelOverride(t *testing.T) {
+	labels := stackLabels{instance: "default", repo: "git@github.com:user/repo.git", commit: "def456"}
+
+	data, err := labelOverride([]string{"app", "db"}, labels.forStack("web", "abc123"))
+	require.NoError(t, err)
+
+	var override struct {
+		Services map[string]struct {
+			Labels map[string]string `yaml:"labels"`
+		} `yaml:"services"`
+	}
+	require.NoError(t, yaml.Unmarshal(data, &override))
+
+	assert.Len(t, override.Services, 2)
+	assert.Equal(t, "web", override.Services["db"].Labels[labelStack])
+	assert.Equal(t, "abc123", override.Services["app"].Labels[labelCommit])
+	assert.Equal(t, "git@github.com:user/repo.git", override.Services["app"].Labels[labelRepo])
+}
+
+func TestCommitLabelFollowsConfigChanges(t *testing.T) {
+	state := newState()
+	state.recordManifest("web", stackManifest{})
+
+	assert.Equal(t, "aaa", state.configCommit("web", "digest-1", "aaa"))
+	state.recordConfig("web", "digest-1", "aaa")
+
+	// Redeploying an unchanged config at a later commit keeps the label, so
+	// compose has nothing to recreate.
+	assert.Equal(t, "aaa", state.configCommit("web", "digest-1", "bbb"))
+
+	assert.Equal(t, "ccc", state.configCommit("web", "digest-2", "ccc"))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+func setupLogging(config Config) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL %q: %w", config.LogLevel, err)
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(config.LogFormat) {
+	case "text", "":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q: must be text or json", config.LogFormat)
+	}
+
+	slog.SetDefault(slog.New(handler).With("repo", config.RepoURL))
+	return nil
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// composeLogWriter turns the raw output of a compose command into one log
+// record per line, tagged with the stack it belongs to.
+type composeLogWriter struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+	buf    bytes.Buffer
+}
+
+func newComposeLogWriter(stackName, action string) *composeLogWriter {
+	return &composeLogWriter{
+		logger: slog.With("stack", stackName, "phase", "compose", "action", action),
+	}
+}
+
+func (w *composeLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	for {
+		data := w.buf.Bytes()
+		i := bytes.IndexAny(data, "\r\n")
+		if i < 0 {
+			break
+		}
+		w.logLine(string(data[:i]))
+		w.buf.Next(i + 1)
+	}
+	return len(p), nil
+}
+
+// Flush logs any trailing output that did not end in a newline.
+func (w *composeLogWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() > 0 {
+		w.logLine(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+func (w *composeLogWriter) logLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	w.logger.Info(line)
+}
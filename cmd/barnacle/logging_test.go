@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComposeLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &composeLogWriter{
+		logger: slog.New(slog.NewJSONHandler(&buf, nil)).With("stack", "web"),
+	}
+
+	w.Write([]byte(" Container web-1  Creating\n Container web-1  Cre"))
+	w.Write([]byte("ated\r\n\n Container web-1  Started"))
+	w.Flush()
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		assert.Equal(t, "web", record["stack"])
+		messages = append(messages, record["msg"].(string))
+	}
+
+	assert.Equal(t, []string{
+		"Container web-1  Creating",
+		"Container web-1  Created",
+		"Container web-1  Started",
+	}, messages)
+}
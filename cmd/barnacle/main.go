@@ -2,39 +2,34 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 )
 
 const (
-	pollInterval  = 30 * time.Second
-	stateFile     = "/app/barnacle-state.json"
-	deployKeyPath = "/ssh/deploy_key"
+	pollInterval   = 30 * time.Second
+	deployKeyPath  = "/ssh/deploy_key"
+	webhookTimeout = 10 * time.Second
 )
 
-type Config struct {
-	RepoURL        string
-	RepoPath       string
-	Branch         string
-	DiscordWebhook string
-}
-
-type State struct {
-	DeployedStacks map[string]bool `json:"deployed_stacks"`
-	LastCommit     string          `json:"last_commit"`
-}
-
 type DiscordWebhook struct {
 	Content string         `json:"content,omitempty"`
 	Embeds  []DiscordEmbed `json:"embeds,omitempty"`
@@ -45,9 +40,14 @@ type DiscordEmbed struct {
 	Description string              `json:"description,omitempty"`
 	Color       int                 `json:"color,omitempty"`
 	Fields      []DiscordEmbedField `json:"fields,omitempty"`
+	Footer      *DiscordEmbedFooter `json:"footer,omitempty"`
 	Timestamp   string              `json:"timestamp,omitempty"`
 }
 
+type DiscordEmbedFooter struct {
+	Text string `json:"text"`
+}
+
 type DiscordEmbedField struct {
 	Name   string `json:"name"`
 	Value  string `json:"value"`
@@ -55,260 +55,315 @@ type DiscordEmbedField struct {
 }
 
 func main() {
-	config := loadConfig()
-
-	log.Printf("Starting barnacle...")
-	log.Printf("Repository: %s", config.RepoURL)
-	log.Printf("Local path: %s", config.RepoPath)
-	log.Printf("Poll interval: %v", pollInterval)
-
-	state := loadState()
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
 
-	repo, err := initializeRepo(config)
+	config, err := loadConfig()
 	if err != nil {
-		log.Fatalf("Failed to initialize repository: %v", err)
+		fatal("Invalid configuration", "error", err)
 	}
-
-	if repo != nil {
-		if err := deployAllStacks(config.RepoPath, state); err != nil {
-			log.Printf("Warning: Initial deployment failed: %v", err)
-		}
-	} else {
-		log.Println("Skipping initial deployment, waiting for repository content...")
+	if err := setupLogging(config); err != nil {
+		fatal("Invalid logging configuration", "error", err)
 	}
+	shutdownTimeout = config.ShutdownTimeout
 
-	ticker := time.NewTicker(pollInterval)
-	defer ticker.Stop()
+	slog.Info("Starting barnacle", "path", config.RepoPath, "branch", config.Branch, "runtime", config.runtime().name, "poll_interval", pollInterval)
 
-	for range ticker.C {
-		log.Println("Checking for updates...")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-		if repo == nil {
-			repo, err = initializeRepo(config)
-			if err != nil {
-				log.Printf("Error initializing repository: %v", err)
-				continue
-			}
-			if repo == nil {
-				continue
-			}
-			log.Println("Repository now has content, performing initial deployment...")
-			if err := deployAllStacks(config.RepoPath, state); err != nil {
-				log.Printf("Error deploying stacks: %v", err)
-			}
-			continue
-		}
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
-		updated, changedFiles, err := pullRepo(repo, config)
+	var targets []*deployTarget
+	for _, docker := range append([]dockerTarget{{}}, config.Targets...) {
+		path := docker.statePath(config.StatePath)
+		state, err := loadState(path)
 		if err != nil {
-			log.Printf("Error pulling repository: %v", err)
-			continue
+			fatal("Failed to load state", "target", docker.displayName(), "path", path, "error", err)
 		}
-
-		if updated {
-			log.Println("Repository updated, deploying changed stacks...")
-
-			sendUpdateDetectedWebhook(config.DiscordWebhook, changedFiles)
-
-			deploymentResults := make(map[string]error)
-			if err := deployChanges(config.RepoPath, changedFiles, state, deploymentResults); err != nil {
-				log.Printf("Error deploying stacks: %v", err)
-			}
-
-			sendDeploymentResultWebhook(config.DiscordWebhook, deploymentResults, changedFiles)
-		} else {
-			log.Println("No updates found")
+		recoverStateFromLabels(ctx, config.forTarget(docker), state)
+		if reason := state.cleanupBlocked(); reason != "" {
+			sendAlertWebhook(config.DiscordWebhook, "🚨 State Not Loaded",
+				fmt.Sprintf("Barnacle could not load its state file for the %s target or recover it from Docker labels, and will not remove any stacks there until an operator checks them and runs `barnacle clear-degraded %s`.", docker.displayName(), docker.displayName()), reason)
 		}
+		targets = append(targets, &deployTarget{docker: docker, state: state})
 	}
-}
-
-func loadConfig() Config {
-	repoURL := getEnv("REPO_URL", "")
-	if repoURL == "" {
-		log.Fatal("REPO_URL environment variable is required")
-	}
-
-	repoName := extractRepoName(repoURL)
-	repoPath := getEnv("REPO_PATH", fmt.Sprintf("/opt/%s", repoName))
-
-	config := Config{
-		RepoURL:        repoURL,
-		RepoPath:       repoPath,
-		Branch:         getEnv("BRANCH", "main"),
-		DiscordWebhook: getEnv("DISCORD_WEBHOOK", ""),
-	}
-
-	return config
-}
 
-func extractRepoName(repoURL string) string {
-	repoURL = strings.TrimSuffix(repoURL, ".git")
+	shared := newSharedConfig(config)
+	triggers := make(chan trigger)
+	audit := newAuditLog(config.AuditLogPath, config.AuditLogMaxSize, config.AuditLogMaxFiles)
+	server := startAPIServer(shared, targets, audit, triggers)
 
-	if strings.Contains(repoURL, ":") && strings.Contains(repoURL, "@") {
-		parts := strings.Split(repoURL, ":")
-		if len(parts) >= 2 {
-			path := parts[len(parts)-1]
-			return filepath.Base(path)
-		}
+	repo, err := initializeRepo(ctx, config)
+	if err != nil {
+		fatal("Failed to initialize repository", "error", err)
 	}
 
-	return filepath.Base(repoURL)
-}
-
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	r := &reconciler{config: config, targets: targets, repo: repo, audit: audit}
+	if repo != nil {
+		appHealth.setRepoReady(true)
+		r.handle(ctx, trigger{kind: triggerRedeployAll, source: sourceStartup})
+	} else {
+		slog.Info("Skipping initial deployment, waiting for repository content")
 	}
-	return defaultValue
-}
 
-func loadState() *State {
-	data, err := os.ReadFile(stateFile)
-	if err != nil {
-		return &State{
-			DeployedStacks: make(map[string]bool),
-		}
-	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
 
-	var state State
-	if err := json.Unmarshal(data, &state); err != nil {
-		log.Printf("Warning: Failed to load state file, creating new state: %v", err)
-		return &State{
-			DeployedStacks: make(map[string]bool),
+	for ctx.Err() == nil {
+		appHealth.tick()
+
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+			slog.Debug("Checking for updates", "phase", "sync")
+			r.handle(ctx, trigger{kind: triggerSync, source: sourcePoll})
+		case t := <-triggers:
+			slog.Info("Manual trigger received", "trigger", t.describe())
+			t.done <- r.handle(ctx, t)
+		case <-reload:
+			slog.Info("SIGHUP received, reloading configuration")
+			next, err := reloadConfig(r.config)
+			if err != nil {
+				slog.Error("Failed to reload configuration, keeping current settings", "error", err)
+				continue
+			}
+			r.config = next
+			shared.set(next)
+			slog.Info("Configuration reloaded")
 		}
 	}
 
-	return &state
-}
-
-func saveState(state *State) error {
-	data, err := json.MarshalIndent(state, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal state: %w", err)
+	slog.Info("Shutting down")
+	for _, t := range targets {
+		saveStateOrWarn(t.state)
 	}
 
-	if err := os.WriteFile(stateFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write state file: %w", err)
+	if server != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Failed to shut down API server cleanly", "error", err)
+		}
 	}
-
-	return nil
+	slog.Info("Shutdown complete")
 }
 
-func initializeRepo(config Config) (*git.Repository, error) {
+func initializeRepo(ctx context.Context, config Config) (*git.Repository, error) {
 	repo, err := git.PlainOpen(config.RepoPath)
 	if err == nil {
-		log.Println("Repository already exists, using existing clone")
+		slog.Info("Repository already exists, using existing clone", "path", config.RepoPath)
 		return repo, nil
 	}
 
-	log.Println("Cloning repository...")
+	slog.Info("Cloning repository", "path", config.RepoPath, "branch", config.Branch)
 	auth, err := getSSHAuth(deployKeyPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup SSH auth: %w", err)
 	}
 
-	repo, err = git.PlainClone(config.RepoPath, false, &git.CloneOptions{
-		URL:           config.RepoURL,
-		Auth:          auth,
-		ReferenceName: plumbing.NewBranchReferenceName(config.Branch),
-		Progress:      os.Stdout,
-	})
+	cloneCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	repo, err = cloneRepo(cloneCtx, config, auth)
 	if err != nil {
 		if strings.Contains(err.Error(), "remote repository is empty") {
-			log.Println("Repository is empty, will wait for content to be pushed")
+			slog.Info("Repository is empty, will wait for content to be pushed")
 			return nil, nil
 		}
 		return nil, fmt.Errorf("failed to clone: %w", err)
 	}
 
-	log.Println("Repository cloned successfully")
+	slog.Info("Repository cloned successfully", "commit", shortHash(headCommit(repo)))
 	return repo, nil
 }
 
-func pullRepo(repo *git.Repository, config Config) (bool, []string, error) {
+// repoUpdate is a move of the checkout from one commit to another.
+type repoUpdate struct {
+	from, to plumbing.Hash
+	// ref names what was checked out: the branch, or the tag or commit a
+	// pinned DEPLOY_REF resolved to.
+	ref          string
+	changedFiles []string
+	// renamedFiles are the files git saw renamed, keyed by their new path.
+	renamedFiles map[string]string
+	// forcePushed is set when the branch was rewritten, so that the new
+	// commit does not descend from the one deployed before.
+	forcePushed bool
+}
+
+// pullRepo fetches the repository and checks out the commit DEPLOY_REF picks,
+// returning nil when that is the commit already deployed.
+func pullRepo(ctx context.Context, repo *git.Repository, config Config, deployed plumbing.Hash) (*repoUpdate, error) {
+	auth, err := getSSHAuth(deployKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup SSH auth: %w", err)
+	}
+	return fetchAndCheckout(ctx, repo, config, auth, deployed)
+}
+
+// fetchAndCheckout hard resets the checkout to the fetched commit rather than
+// merging, so a force-pushed branch is followed like any other update. Changes
+// are the difference between the trees of the commit deployed before and the
+// new one, whether or not they share history. The commit deployed before is
+// the one the state recorded, or HEAD when there is none, so a pass that was
+// cut short is picked up again from where it started.
+func fetchAndCheckout(ctx context.Context, repo *git.Repository, config Config, auth transport.AuthMethod, deployed plumbing.Hash) (*repoUpdate, error) {
 	w, err := repo.Worktree()
 	if err != nil {
-		return false, nil, fmt.Errorf("failed to get worktree: %w", err)
+		return nil, fmt.Errorf("failed to get worktree: %w", err)
 	}
 
 	headBefore, err := repo.Head()
 	if err != nil {
-		return false, nil, fmt.Errorf("failed to get HEAD: %w", err)
+		return nil, fmt.Errorf("failed to get HEAD: %w", err)
 	}
 
-	err = w.Reset(&git.ResetOptions{
+	err = w.ResetSparsely(&git.ResetOptions{
 		Mode: git.HardReset,
-	})
+	}, config.SparseDirs)
 	if err != nil {
-		return false, nil, fmt.Errorf("failed to reset worktree: %w", err)
+		return nil, fmt.Errorf("failed to reset worktree: %w", err)
 	}
 
-	auth, err := getSSHAuth(deployKeyPath)
-	if err != nil {
-		return false, nil, fmt.Errorf("failed to setup SSH auth: %w", err)
-	}
+	fetchCtx, cancel := commandContext(ctx)
+	defer cancel()
 
-	err = w.Pull(&git.PullOptions{
-		Auth:          auth,
-		ReferenceName: plumbing.NewBranchReferenceName(config.Branch),
-	})
+	fetchOptions := &git.FetchOptions{Auth: auth, Force: true}
+	if config.DeployRef.pinned() {
+		fetchOptions.Tags = git.AllTags
+	}
+	fetchStart := time.Now()
+	err = repo.FetchContext(fetchCtx, fetchOptions)
+	appMetrics.observeGitFetch(time.Since(fetchStart))
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, fmt.Errorf("failed to fetch: %w", err)
+	}
 
-	if err != nil {
-		if err == git.NoErrAlreadyUpToDate {
-			return false, nil, nil
+	update := &repoUpdate{from: cmp.Or(deployed, headBefore.Hash())}
+	if config.DeployRef.pinned() {
+		update.to, update.ref, err = resolveRef(repo, config.DeployRef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve DEPLOY_REF %s: %w", config.DeployRef, err)
+		}
+	} else {
+		remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, config.Branch), true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find remote branch %s: %w", config.Branch, err)
 		}
-		return false, nil, fmt.Errorf("failed to pull: %w", err)
+		update.to, update.ref = remoteRef.Hash(), config.Branch
+	}
+
+	branch := plumbing.NewBranchReferenceName(config.Branch)
+	onBranch := headBefore.Name() == branch
+	if update.to == update.from && (onBranch || config.DeployRef.pinned()) {
+		return nil, nil
 	}
 
-	headAfter, err := repo.Head()
+	// Checked before anything moves, so a refused commit never reaches the
+	// worktree.
+	if err := verifyCommits(repo, update.from, update.to, config); err != nil {
+		slog.Error("Refusing commit, keeping the last verified commit", "phase", "sync", "ref", update.ref, "commit", shortHash(update.to.String()), "error", err)
+		return nil, err
+	}
+
+	if config.DeployRef.pinned() {
+		err = w.Checkout(&git.CheckoutOptions{Hash: update.to, Force: true, SparseCheckoutDirectories: config.SparseDirs})
+	} else {
+		// HEAD goes back on the branch, coming from a pin, before the branch
+		// is reset to the remote.
+		if !onBranch {
+			if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch)); err != nil {
+				return nil, fmt.Errorf("failed to check out %s: %w", config.Branch, err)
+			}
+		}
+		err = w.ResetSparsely(&git.ResetOptions{Commit: update.to, Mode: git.HardReset}, config.SparseDirs)
+	}
 	if err != nil {
-		return false, nil, fmt.Errorf("failed to get HEAD after pull: %w", err)
+		return nil, fmt.Errorf("failed to check out %s: %w", update.ref, err)
+	}
+	if update.to == update.from {
+		return nil, nil
 	}
 
-	updated := headBefore.Hash() != headAfter.Hash()
-	if !updated {
-		return false, nil, nil
+	if !config.DeployRef.pinned() {
+		ancestor, err := isAncestor(repo, update.from, update.to)
+		update.forcePushed = err == nil && !ancestor
+	}
+	if update.forcePushed {
+		slog.Warn("Branch was force-pushed, deploying the rewritten history", "phase", "sync", "ref", update.ref, "from", shortHash(update.from.String()), "commit", shortHash(update.to.String()))
+	} else {
+		slog.Info("Repository updated", "phase", "sync", "ref", update.ref, "from", shortHash(update.from.String()), "commit", shortHash(update.to.String()))
 	}
 
-	log.Printf("Updated from %s to %s", headBefore.Hash().String()[:7], headAfter.Hash().String()[:7])
+	update.changedFiles, update.renamedFiles, err = getChangedFiles(repo, update.from, update.to)
+	if errors.Is(err, plumbing.ErrObjectNotFound) && config.CloneDepth > 0 {
+		// A shallow clone may not have the commit deployed before.
+		if err = deepenHistory(fetchCtx, repo, auth, update.from, config.CloneDepth); err == nil {
+			update.changedFiles, update.renamedFiles, err = getChangedFiles(repo, update.from, update.to)
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to get changed files, will deploy all stacks", "phase", "sync", "error", err)
+		update.changedFiles, update.renamedFiles = nil, nil
+	}
+	return update, nil
+}
 
-	changedFiles, err := getChangedFiles(repo, headBefore.Hash(), headAfter.Hash())
+func headCommit(repo *git.Repository) string {
+	if repo == nil {
+		return ""
+	}
+
+	head, err := repo.Head()
 	if err != nil {
-		log.Printf("Warning: Failed to get changed files, will deploy all stacks: %v", err)
-		return true, nil, nil
+		return ""
 	}
+	return head.Hash().String()
+}
 
-	return true, changedFiles, nil
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
 }
 
-func getChangedFiles(repo *git.Repository, oldCommit, newCommit plumbing.Hash) ([]string, error) {
+func getChangedFiles(repo *git.Repository, oldCommit, newCommit plumbing.Hash) ([]string, map[string]string, error) {
 	commitOld, err := repo.CommitObject(oldCommit)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	commitNew, err := repo.CommitObject(newCommit)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	treeOld, err := commitOld.Tree()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	treeNew, err := commitNew.Tree()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	changes, err := treeOld.Diff(treeNew)
+	changes, err := object.DiffTreeWithOptions(context.Background(), treeOld, treeNew, object.DefaultDiffTreeOptions)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var changedFiles []string
+	renamedFiles := make(map[string]string)
 	for _, change := range changes {
+		if change.From.Name != "" && change.To.Name != "" && change.From.Name != change.To.Name {
+			changedFiles = append(changedFiles, change.From.Name)
+			renamedFiles[change.To.Name] = change.From.Name
+		}
 		if change.To.Name != "" {
 			changedFiles = append(changedFiles, change.To.Name)
 		} else if change.From.Name != "" {
@@ -316,7 +371,7 @@ func getChangedFiles(repo *git.Repository, oldCommit, newCommit plumbing.Hash) (
 		}
 	}
 
-	return changedFiles, nil
+	return changedFiles, renamedFiles, nil
 }
 
 func getSSHAuth(keyPath string) (*ssh.PublicKeys, error) {
@@ -328,98 +383,112 @@ func getSSHAuth(keyPath string) (*ssh.PublicKeys, error) {
 	return auth, nil
 }
 
-func deployAllStacks(repoPath string, state *State) error {
-	entries, err := os.ReadDir(repoPath)
+func deployAllStacks(ctx context.Context, config Config, labels stackLabels, state *State, results map[string]error) error {
+	repoPath := config.stacksPath()
+	currentStacks, suspendedStacks, brokenStacks, err := getCurrentStacks(config)
 	if err != nil {
-		return fmt.Errorf("failed to read repo directory: %w", err)
-	}
-
-	currentStacks := make(map[string]bool)
-	deployedCount := 0
-
-	for _, entry := range entries {
-		if !entry.IsDir() || entry.Name()[0] == '.' {
-			continue
-		}
-
-		stackName := entry.Name()
-		stackPath := filepath.Join(repoPath, stackName)
-
-		if _, err := os.Stat(filepath.Join(stackPath, "ignore")); err == nil {
-			log.Printf("Skipping %s: ignore file present", stackName)
-			continue
-		}
-
-		if !hasComposeFile(stackPath) {
-			log.Printf("Skipping %s: no compose file found", stackName)
-			continue
-		}
-
-		currentStacks[stackName] = true
-
-		log.Printf("Deploying stack: %s", stackName)
-		if err := dockerComposeUp(stackPath); err != nil {
-			log.Printf("Failed to deploy stack %s: %v", stackName, err)
-			continue
-		}
-
-		deployedCount++
-		log.Printf("Successfully deployed stack: %s", stackName)
+		return err
 	}
 
 	deletedStacks := []string{}
 	for stackName := range state.DeployedStacks {
-		if !currentStacks[stackName] {
+		if !currentStacks[stackName] && !suspendedStacks[stackName] && brokenStacks[stackName] == nil {
 			deletedStacks = append(deletedStacks, stackName)
 		}
 	}
-	cleanupDeletedStacks(repoPath, deletedStacks, make(map[string]error))
+	renames := detectRenames(repoPath, state, currentStacks, deletedStacks, nil)
+	deletedStacks = applyRenames(state, renames, deletedStacks)
 
-	state.DeployedStacks = currentStacks
-	if err := saveState(state); err != nil {
-		log.Printf("Warning: Failed to save state: %v", err)
+	skipped := deployStacks(ctx, config, currentStacks, labels, state, results)
+	reportRenames(results, renames)
+	slog.Info("Deployment complete", "phase", "deploy", "deployed", deployedCount(results, currentStacks), "skipped", len(skipped))
+	forgetUnreachedStacks(state, currentStacks, skipped)
+
+	keepSuspendedStacks(state, currentStacks, suspendedStacks)
+	keepBrokenStacks(state, currentStacks, brokenStacks, results)
+	releaseDeletion(state, currentStacks)
+	for _, stackName := range removeDeletedStacks(ctx, config, deletedStacks, state, results) {
+		currentStacks[stackName] = true
 	}
 
-	log.Printf("Deployment complete: %d stack(s) deployed", deployedCount)
+	state.setDeployedStacks(currentStacks)
+	saveStateOrWarn(state)
 	return nil
 }
 
 func hasComposeFile(stackPath string) bool {
-	for _, filename := range []string{"docker-compose.yml", "docker-compose.yaml", "compose.yml", "compose.yaml"} {
-		if _, err := os.Stat(filepath.Join(stackPath, filename)); err == nil {
-			return true
-		}
-	}
-	return false
+	return composeFiles(stackPath) != nil
 }
 
-func dockerComposeUp(stackPath string) error {
-	cmd := exec.Command("docker", "compose", "up", "-d", "--remove-orphans")
-	cmd.Dir = stackPath
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func dockerComposeUp(ctx context.Context, project composeProject, labels map[string]string) error {
+	output := newComposeLogWriter(project.stack, "up")
+	defer output.Flush()
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	override, err := writeLabelOverride(cmdCtx, project, labels)
+	if err != nil {
+		return fmt.Errorf("failed to write label override: %w", err)
+	}
+	defer os.Remove(override)
+
+	args := append(project.args(override), "up", "-d")
+	if project.runtime.removeOrphans {
+		args = append(args, "--remove-orphans")
+	}
+	args = append(args, project.upFlags...)
+
+	cmd := project.command(cmdCtx, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
 
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("docker compose up failed: %w", err)
+		return fmt.Errorf("%s up failed: %w", project.runtime.name, err)
 	}
 
+	if !project.runtime.removeOrphans {
+		services, err := composeServices(cmdCtx, project)
+		if err != nil {
+			return err
+		}
+		return removeProjectContainers(cmdCtx, project, services, false)
+	}
 	return nil
 }
 
-func dockerComposeDown(stackPath string, projectName string) error {
-	if _, err := os.Stat(stackPath); err == nil {
-		cmd := exec.Command("docker", "compose", "down", "--remove-orphans")
-		cmd.Dir = stackPath
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		return cmd.Run()
+func dockerComposeDown(ctx context.Context, project composeProject, removeVolumes bool) error {
+	output := newComposeLogWriter(project.stack, "down")
+	defer output.Flush()
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	// Runtimes without --remove-orphans also need the compose files for down,
+	// so once they are gone the project is removed by its label instead.
+	if !project.runtime.removeOrphans && project.dir == "" {
+		return removeProjectContainers(cmdCtx, project, nil, removeVolumes)
 	}
 
-	cmd := exec.Command("docker", "compose", "-p", projectName, "down", "--remove-orphans")
-	cmd.Dir = "/"
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	args := append(project.args(), "down")
+	if project.runtime.removeOrphans {
+		args = append(args, "--remove-orphans")
+	}
+	if removeVolumes {
+		args = append(args, "--volumes")
+	}
+
+	cmd := project.command(cmdCtx, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	if !project.runtime.removeOrphans {
+		return removeProjectContainers(cmdCtx, project, nil, false)
+	}
+	return nil
 }
 
 func mapKeys(m map[string]bool) []string {
@@ -430,139 +499,209 @@ func mapKeys(m map[string]bool) []string {
 	return keys
 }
 
-func deployChanges(repoPath string, changedFiles []string, state *State, results map[string]error) error {
+func deployChanges(ctx context.Context, config Config, changedFiles []string, renamedFiles map[string]string, labels stackLabels, state *State, results map[string]error) error {
 	if changedFiles == nil {
-		return deployAllStacks(repoPath, state)
+		return deployAllStacks(ctx, config, labels, state, results)
 	}
 
-	currentStacks, err := getCurrentStacks(repoPath)
+	repoPath := config.stacksPath()
+	currentStacks, suspendedStacks, brokenStacks, err := getCurrentStacks(config)
 	if err != nil {
 		return err
 	}
 
-	affectedStacks, deletedStacks := getAffectedStacks(changedFiles, currentStacks, state.DeployedStacks)
-
-	deployStacks(repoPath, affectedStacks, results)
-	cleanupDeletedStacks(repoPath, deletedStacks, results)
+	managedStacks := make(map[string]bool)
+	for stackName := range state.DeployedStacks {
+		if !suspendedStacks[stackName] && brokenStacks[stackName] == nil {
+			managedStacks[stackName] = true
+		}
+	}
+	affectedStacks, deletedStacks := getAffectedStacks(config.stackRelativePaths(changedFiles), currentStacks, managedStacks)
+	for stackName := range dependentStacks(changedFiles, stackDependencies(config, currentStacks)) {
+		affectedStacks[stackName] = true
+	}
 
-	state.DeployedStacks = currentStacks
-	if err := saveState(state); err != nil {
-		log.Printf("Warning: Failed to save state: %v", err)
+	// A file git saw move from one stack to another makes that a rename.
+	renamedStacks := make(map[string]string)
+	for newFile, oldFile := range renamedFiles {
+		newStack := owningStack(config.stackRelativePath(newFile), currentStacks)
+		oldStack := owningStack(config.stackRelativePath(oldFile), state.DeployedStacks)
+		if newStack != "" && oldStack != "" && newStack != oldStack {
+			renamedStacks[newStack] = oldStack
+		}
 	}
 
-	log.Printf("Deployment complete: %d stack(s) deployed", len(affectedStacks))
-	return nil
-}
+	// Renamed stacks were picked up as new, so they are already affected.
+	renames := detectRenames(repoPath, state, currentStacks, deletedStacks, renamedStacks)
+	deletedStacks = applyRenames(state, renames, deletedStacks)
 
-func getCurrentStacks(repoPath string) (map[string]bool, error) {
-	entries, err := os.ReadDir(repoPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read repo directory: %w", err)
-	}
+	skipped := deployStacks(ctx, config, affectedStacks, labels, state, results)
+	reportRenames(results, renames)
+	slog.Info("Deployment complete", "phase", "deploy", "deployed", deployedCount(results, affectedStacks), "skipped", len(skipped))
+	forgetUnreachedStacks(state, currentStacks, skipped)
 
-	currentStacks := make(map[string]bool)
-	for _, entry := range entries {
-		if !entry.IsDir() || entry.Name()[0] == '.' {
-			continue
-		}
+	keepSuspendedStacks(state, currentStacks, suspendedStacks)
+	keepBrokenStacks(state, currentStacks, brokenStacks, results)
+	releaseDeletion(state, currentStacks)
+	for _, stackName := range removeDeletedStacks(ctx, config, deletedStacks, state, results) {
+		currentStacks[stackName] = true
+	}
 
-		stackName := entry.Name()
-		stackPath := filepath.Join(repoPath, stackName)
+	state.setDeployedStacks(currentStacks)
+	saveStateOrWarn(state)
+	return nil
+}
 
-		if _, err := os.Stat(filepath.Join(stackPath, "ignore")); err == nil {
-			continue
+// keepSuspendedStacks adds deployed stacks that are now suspended back into
+// the inventory, so they are neither redeployed nor torn down, and marks them
+// suspended in the state.
+func keepSuspendedStacks(state *State, currentStacks, suspendedStacks map[string]bool) {
+	for stackName := range suspendedStacks {
+		if state.DeployedStacks[stackName] {
+			currentStacks[stackName] = true
+			state.markSuspended(stackName)
 		}
+	}
+}
 
-		if !hasComposeFile(stackPath) {
-			continue
+// keepBrokenStacks reports the stacks that cannot be deployed as failed, and
+// keeps the deployed ones in the inventory, running as they were, until they
+// are fixed.
+func keepBrokenStacks(state *State, currentStacks map[string]bool, brokenStacks map[string]error, results map[string]error) {
+	for stackName, err := range brokenStacks {
+		results[stackName] = err
+		if state.DeployedStacks[stackName] {
+			currentStacks[stackName] = true
 		}
-
-		currentStacks[stackName] = true
 	}
-
-	log.Printf("Current stacks on disk: %v", mapKeys(currentStacks))
-	return currentStacks, nil
 }
 
 func getAffectedStacks(changedFiles []string, currentStacks, deployedStacks map[string]bool) (map[string]bool, []string) {
 	affectedStacks := make(map[string]bool)
 	for _, file := range changedFiles {
-		parts := strings.Split(file, "/")
-		if len(parts) > 0 {
-			stackName := parts[0]
-			if stackName == ".." {
-				log.Printf("    ✗ Skipping potentially malicious path: %s", file)
-				continue
-			}
-			if stackName == "." {
-				if len(parts) > 1 {
-					stackName = parts[1]
-				} else {
-					continue
-				}
-			}
-			if currentStacks[stackName] {
-				affectedStacks[stackName] = true
-			}
+		file = path.Clean(file)
+		if file == ".." || strings.HasPrefix(file, "../") {
+			slog.Warn("Skipping potentially malicious path", "path", file)
+			continue
+		}
+		if stackName := owningStack(file, currentStacks); stackName != "" {
+			affectedStacks[stackName] = true
 		}
 	}
 
 	for stackName := range currentStacks {
 		if !deployedStacks[stackName] {
 			affectedStacks[stackName] = true
-			log.Printf("New stack detected: %s", stackName)
+			slog.Info("New stack detected", "stack", stackName)
 		}
 	}
 
 	deletedStacks := []string{}
 	for stackName := range deployedStacks {
 		if !currentStacks[stackName] {
-			log.Printf("Deleted stack detected: %s", stackName)
+			slog.Info("Deleted stack detected", "stack", stackName)
 			deletedStacks = append(deletedStacks, stackName)
 		}
 	}
 
-	log.Printf("Affected stacks: %v", mapKeys(affectedStacks))
+	slog.Info("Affected stacks", "stacks", mapKeys(affectedStacks))
 	return affectedStacks, deletedStacks
 }
 
-func deployStacks(repoPath string, affectedStacks map[string]bool, results map[string]error) {
+// deployStacks deploys each affected stack and returns those it did not get
+// to because shutdown was requested.
+func deployStacks(ctx context.Context, config Config, affectedStacks map[string]bool, labels stackLabels, state *State, results map[string]error) []string {
+	var skipped []string
 	for stackName := range affectedStacks {
-		stackPath := filepath.Join(repoPath, stackName)
+		if ctx.Err() != nil {
+			skipped = append(skipped, stackName)
+			continue
+		}
 
-		log.Printf("Deploying stack: %s", stackName)
-		if err := dockerComposeUp(stackPath); err != nil {
-			log.Printf("Failed to deploy stack %s: %v", stackName, err)
+		stackPath := filepath.Join(config.stacksPath(), stackName)
+
+		manifest, err := loadStackManifest(stackPath)
+		if err != nil {
+			slog.Error("Failed to load stack manifest", "stack", stackName, "phase", "deploy", "error", err)
+			results[stackName] = err
+			continue
+		}
+		previousProject := state.stackProject(stackName)
+		state.recordManifest(stackName, manifest)
+
+		slog.Info("Deploying stack", "stack", stackName, "phase", "deploy")
+		deployStart := time.Now()
+		project := newComposeProject(config, stackName, stackPath, state.pinnedProject(stackName), manifest)
+		if !project.pinned {
+			project.name, err = resolveProjectName(ctx, project)
+			if err == nil {
+				state.recordComposeProject(stackName, project.name)
+			}
+		}
+		if err == nil {
+			err = enforcePolicy(ctx, config, project)
+		}
+		if err == nil && state.DeployedStacks[stackName] && project.name != previousProject {
+			err = moveProject(ctx, config, stackName, previousProject, project)
+		}
+		var digest, commit string
+		if err == nil {
+			digest, err = configDigest(ctx, project)
+		}
+		if err == nil {
+			commit = state.configCommit(stackName, digest, labels.commit)
+			err = dockerComposeUp(ctx, project, labels.forStack(stackName, commit))
+		}
+		if err == nil {
+			state.recordConfig(stackName, digest, commit)
+		}
+		duration := time.Since(deployStart)
+		appMetrics.observeStackDeploy(config.Target.displayName(), stackName, duration, err)
+		if err != nil {
+			slog.Error("Failed to deploy stack", "stack", stackName, "phase", "deploy", "duration", duration, "error", err)
 			results[stackName] = err
 			continue
 		}
 
 		results[stackName] = nil
-		log.Printf("Successfully deployed stack: %s", stackName)
+		slog.Info("Successfully deployed stack", "stack", stackName, "phase", "deploy", "duration", duration)
+	}
+
+	if len(skipped) > 0 {
+		slog.Warn("Shutdown requested, skipped remaining stacks", "phase", "deploy", "stacks", skipped)
 	}
+	return skipped
 }
 
-func cleanupDeletedStacks(repoPath string, deletedStacks []string, results map[string]error) {
-	for _, stackName := range deletedStacks {
-		stackPath := filepath.Join(repoPath, stackName)
-		log.Printf("Stack %s was deleted, running docker compose down...", stackName)
+// deployedCount counts the stacks that deployed successfully. A renamed stack's
+// result is keyed by its rename, so keys are matched by the stack they name.
+func deployedCount(results map[string]error, stacks map[string]bool) int {
+	count := 0
+	for key, err := range results {
+		stackName, outcome := parseResultKey(key)
+		if err == nil && outcome == stackStatusDeployed && stacks[stackName] {
+			count++
+		}
+	}
+	return count
+}
 
-		if err := dockerComposeDown(stackPath, stackName); err != nil {
-			log.Printf("Warning: Failed to stop deleted stack %s: %v", stackName, err)
-			results[stackName+" (deleted)"] = err
-		} else {
-			log.Printf("Successfully stopped deleted stack: %s", stackName)
-			results[stackName+" (deleted)"] = nil
+// forgetUnreachedStacks leaves new stacks that shutdown kept from deploying
+// out of the inventory, so the next pass still sees them as new.
+func forgetUnreachedStacks(state *State, currentStacks map[string]bool, skipped []string) {
+	for _, stackName := range skipped {
+		if !state.DeployedStacks[stackName] {
+			delete(currentStacks, stackName)
 		}
 	}
 }
 
-func sendUpdateDetectedWebhook(webhookURL string, changedFiles []string) {
+func sendUpdateDetectedWebhook(webhookURL string, update *repoUpdate) {
 	if webhookURL == "" {
 		return
 	}
 
-	filesText := strings.Join(changedFiles, "\n")
+	filesText := strings.Join(update.changedFiles, "\n")
 	if len(filesText) > 1000 {
 		filesText = filesText[:997] + "..."
 	}
@@ -579,6 +718,14 @@ func sendUpdateDetectedWebhook(webhookURL string, changedFiles []string) {
 		},
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
+	if update.forcePushed {
+		embed.Description = "Branch was force-pushed"
+		embed.Color = 16776960
+		embed.Fields = append(embed.Fields, DiscordEmbedField{
+			Name:  "⚠️ History Rewritten",
+			Value: fmt.Sprintf("%s is no longer in the history of %s. Changes are compared against the commit deployed before.", shortHash(update.from.String()), shortHash(update.to.String())),
+		})
+	}
 
 	webhook := DiscordWebhook{
 		Embeds: []DiscordEmbed{embed},
@@ -587,19 +734,24 @@ func sendUpdateDetectedWebhook(webhookURL string, changedFiles []string) {
 	sendDiscordWebhook(webhookURL, webhook)
 }
 
-func sendDeploymentResultWebhook(webhookURL string, results map[string]error, changedFiles []string) {
+func sendDeploymentResultWebhook(webhookURL string, results map[string]error, changedFiles []string, footer string) {
 	if webhookURL == "" {
 		return
 	}
 
 	successStacks := []string{}
 	failedStacks := []string{}
-
-	for stackName, err := range results {
-		if err == nil {
-			successStacks = append(successStacks, stackName)
-		} else {
-			failedStacks = append(failedStacks, fmt.Sprintf("%s: %v", stackName, err))
+	deletions := []string{}
+
+	for _, key := range sortedKeys(results) {
+		stackName, outcome := parseResultKey(key)
+		switch {
+		case results[key] != nil:
+			failedStacks = append(failedStacks, fmt.Sprintf("%s: %v", key, results[key]))
+		case outcome == stackStatusDeployed:
+			successStacks = append(successStacks, key)
+		default:
+			deletions = append(deletions, fmt.Sprintf("%s: %s", stackName, outcome))
 		}
 	}
 
@@ -611,7 +763,7 @@ func sendDeploymentResultWebhook(webhookURL string, results map[string]error, ch
 		title = "✅ Deployment Successful"
 		color = 3066993
 		description = "All stacks deployed successfully"
-	} else if len(successStacks) == 0 {
+	} else if len(successStacks) == 0 && len(deletions) == 0 {
 		title = "❌ Deployment Failed"
 		color = 15158332
 		description = "All stacks failed to deploy"
@@ -634,6 +786,17 @@ func sendDeploymentResultWebhook(webhookURL string, results map[string]error, ch
 		})
 	}
 
+	if len(deletions) > 0 {
+		deletionText := strings.Join(deletions, "\n")
+		if len(deletionText) > 1000 {
+			deletionText = deletionText[:997] + "..."
+		}
+		fields = append(fields, DiscordEmbedField{
+			Name:  fmt.Sprintf("🗑️ Deleted from repo (%d)", len(deletions)),
+			Value: "```\n" + deletionText + "\n```",
+		})
+	}
+
 	if len(failedStacks) > 0 {
 		failedText := strings.Join(failedStacks, "\n")
 		if len(failedText) > 1000 {
@@ -652,6 +815,38 @@ func sendDeploymentResultWebhook(webhookURL string, results map[string]error, ch
 		Fields:      fields,
 		Timestamp:   time.Now().Format(time.RFC3339),
 	}
+	if footer != "" {
+		embed.Footer = &DiscordEmbedFooter{Text: footer}
+	}
+
+	webhook := DiscordWebhook{
+		Embeds: []DiscordEmbed{embed},
+	}
+
+	sendDiscordWebhook(webhookURL, webhook)
+}
+
+func sendAlertWebhook(webhookURL string, title string, description string, detail string) {
+	if webhookURL == "" {
+		return
+	}
+
+	if len(detail) > 1000 {
+		detail = detail[:997] + "..."
+	}
+
+	embed := DiscordEmbed{
+		Title:       title,
+		Description: description,
+		Color:       15158332,
+		Fields: []DiscordEmbedField{
+			{
+				Name:  "Details",
+				Value: "```\n" + detail + "\n```",
+			},
+		},
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
 
 	webhook := DiscordWebhook{
 		Embeds: []DiscordEmbed{embed},
@@ -667,20 +862,24 @@ func sendDiscordWebhook(webhookURL string, webhook DiscordWebhook) {
 
 	jsonData, err := json.Marshal(webhook)
 	if err != nil {
-		log.Printf("Failed to marshal Discord webhook: %v", err)
+		slog.Error("Failed to marshal Discord webhook", "phase", "notify", "error", err)
+		appMetrics.observeNotificationFailure()
 		return
 	}
 
-	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(jsonData))
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		log.Printf("Failed to send Discord webhook: %v", err)
+		slog.Warn("Failed to send Discord webhook", "phase", "notify", "error", err)
+		appMetrics.observeNotificationFailure()
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		log.Printf("Discord webhook returned non-2xx status: %d", resp.StatusCode)
+		slog.Warn("Discord webhook returned non-2xx status", "phase", "notify", "status", resp.StatusCode)
+		appMetrics.observeNotificationFailure()
 	} else {
-		log.Println("Discord webhook sent successfully")
+		slog.Debug("Discord webhook sent successfully", "phase", "notify")
 	}
 }
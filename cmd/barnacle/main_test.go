@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"testing"
 
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetAffectedStacks(t *testing.T) {
@@ -79,6 +84,14 @@ func TestGetAffectedStacks(t *testing.T) {
 			expectedAffected: map[string]bool{"stack1": true, "stack4": true},
 			expectedDeleted:  []string{"stack2"},
 		},
+		{
+			name:             "Nested stacks map to the deepest owner",
+			changedFiles:     []string{"prod/api/worker/compose.yml", "prod/api/.env", "prod/notes.md"},
+			currentStacks:    map[string]bool{"prod/api": true, "prod/api/worker": true, "prod/db": true},
+			deployedStacks:   map[string]bool{"prod/api": true, "prod/api/worker": true, "prod/db": true},
+			expectedAffected: map[string]bool{"prod/api": true, "prod/api/worker": true},
+			expectedDeleted:  []string{},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -89,3 +102,100 @@ func TestGetAffectedStacks(t *testing.T) {
 		})
 	}
 }
+
+func TestFetchAndCheckoutFollowsForcePush(t *testing.T) {
+	upstreamPath := t.TempDir()
+	upstream, err := git.PlainInit(upstreamPath, false)
+	require.NoError(t, err)
+	base := commitFile(t, upstream, "a", &git.CommitOptions{})
+	head, err := upstream.Head()
+	require.NoError(t, err)
+	config := Config{Branch: head.Name().Short()}
+
+	repo, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: upstreamPath})
+	require.NoError(t, err)
+
+	update, err := fetchAndCheckout(context.Background(), repo, config, nil, plumbing.ZeroHash)
+	require.NoError(t, err)
+	assert.Nil(t, update)
+
+	fastForward := commitFile(t, upstream, "b", &git.CommitOptions{})
+	update, err = fetchAndCheckout(context.Background(), repo, config, nil, plumbing.ZeroHash)
+	require.NoError(t, err)
+	require.NotNil(t, update)
+	assert.Equal(t, fastForward, update.to)
+	assert.False(t, update.forcePushed)
+	assert.Equal(t, []string{"b"}, update.changedFiles)
+
+	w, err := upstream.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, w.Reset(&git.ResetOptions{Commit: base, Mode: git.HardReset}))
+	rewritten := commitFile(t, upstream, "c", &git.CommitOptions{})
+
+	update, err = fetchAndCheckout(context.Background(), repo, config, nil, plumbing.ZeroHash)
+	require.NoError(t, err)
+	require.NotNil(t, update)
+	assert.Equal(t, fastForward, update.from)
+	assert.Equal(t, rewritten, update.to)
+	assert.True(t, update.forcePushed)
+	assert.ElementsMatch(t, []string{"b", "c"}, update.changedFiles)
+	assert.Equal(t, rewritten.String(), headCommit(repo))
+}
+
+func TestFetchAndCheckoutDiffsFromDeployedCommit(t *testing.T) {
+	upstreamPath := t.TempDir()
+	upstream, err := git.PlainInit(upstreamPath, false)
+	require.NoError(t, err)
+	deployed := commitFile(t, upstream, "a", &git.CommitOptions{})
+	head, err := upstream.Head()
+	require.NoError(t, err)
+	config := Config{Branch: head.Name().Short()}
+
+	repo, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: upstreamPath})
+	require.NoError(t, err)
+
+	// A pass checked out b but was cut short before deploying it.
+	commitFile(t, upstream, "b", &git.CommitOptions{})
+	_, err = fetchAndCheckout(context.Background(), repo, config, nil, deployed)
+	require.NoError(t, err)
+
+	update, err := fetchAndCheckout(context.Background(), repo, config, nil, deployed)
+	require.NoError(t, err)
+	require.NotNil(t, update, "the undeployed commit is picked up again")
+	assert.Equal(t, deployed, update.from)
+	assert.Equal(t, []string{"b"}, update.changedFiles)
+
+	latest := commitFile(t, upstream, "c", &git.CommitOptions{})
+	update, err = fetchAndCheckout(context.Background(), repo, config, nil, deployed)
+	require.NoError(t, err)
+	require.NotNil(t, update)
+	assert.Equal(t, latest, update.to)
+	assert.ElementsMatch(t, []string{"b", "c"}, update.changedFiles)
+}
+
+func TestInterruptedPassLeavesNewStacksOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	state := newState()
+	state.setDeployedStacks(map[string]bool{"web": true})
+	currentStacks := map[string]bool{"web": true, "db": true}
+
+	results := make(map[string]error)
+	skipped := deployStacks(ctx, Config{RepoPath: t.TempDir()}, currentStacks, stackLabels{}, state, results)
+	assert.ElementsMatch(t, []string{"web", "db"}, skipped)
+	assert.Empty(t, results)
+
+	forgetUnreachedStacks(state, currentStacks, skipped)
+	assert.Equal(t, map[string]bool{"web": true}, currentStacks)
+}
+
+func TestDeployedCount(t *testing.T) {
+	results := map[string]error{
+		"web":                        nil,
+		"db":                         errors.New("up failed"),
+		"api (renamed from backend)": nil,
+		"old (deleted)":              nil,
+	}
+	assert.Equal(t, 2, deployedCount(results, map[string]bool{"web": true, "db": true, "api": true}))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifestFileName is the optional per-stack settings file, next to the
+// compose file in the stack directory.
+const manifestFileName = "barnacle.yml"
+
+const (
+	deletePolicyDown        = "down"
+	deletePolicyDownVolumes = "down-volumes"
+	deletePolicyOrphan      = "orphan"
+	deletePolicyKeep        = "keep"
+)
+
+// Marker files that take a stack out of reconciling. ignore predates the
+// other two and means the same as suspend.
+const (
+	stackModeSuspend = "suspend"
+	stackModeRemove  = "remove"
+	stackModeIgnore  = "ignore"
+)
+
+var validProjectName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// stackManifest is what a stack can say about how barnacle handles it.
+type stackManifest struct {
+	// ID identifies the stack across renames of its directory.
+	ID string `yaml:"id"`
+
+	// Suspend leaves the stack running as it is but stops reconciling it.
+	Suspend bool `yaml:"suspend"`
+	// Remove tears the stack down while keeping its directory in the repo.
+	Remove bool `yaml:"remove"`
+
+	// Files replaces compose's own file lookup; later files are layered
+	// on top of earlier ones.
+	Files    []string `yaml:"files"`
+	Profiles []string `yaml:"profiles"`
+	Project  string   `yaml:"project"`
+	// EnvFiles replace the .env file compose would otherwise read.
+	EnvFiles []string `yaml:"env_files"`
+	// UpFlags are added to docker compose up, e.g. --build or --pull always.
+	UpFlags []string `yaml:"up_flags"`
+
+	// Environments and Hosts restrict the stack to instances with a
+	// matching ENVIRONMENT or HOST_NAME.
+	Environments []string `yaml:"environments"`
+	Hosts        []string `yaml:"hosts"`
+	// Selector restricts the stack to instances whose HOST_LABELS have all
+	// of these values.
+	Selector map[string]string `yaml:"selector"`
+	// Target is the DOCKER_TARGETS entry the stack is deployed to, instead
+	// of the Docker engine barnacle runs against.
+	Target string `yaml:"target"`
+
+	// Watch lists extra paths, relative to the stack directory, whose
+	// changes redeploy the stack.
+	Watch []string `yaml:"watch"`
+
+	// Prune: false protects the stack, the same as on_delete: keep.
+	Prune    *bool  `yaml:"prune"`
+	OnDelete string `yaml:"on_delete"`
+}
+
+func loadStackManifest(stackPath string) (stackManifest, error) {
+	var manifest stackManifest
+
+	data, err := os.ReadFile(filepath.Join(stackPath, manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read %s: %w", manifestFileName, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&manifest); err != nil && !errors.Is(err, io.EOF) {
+		return manifest, fmt.Errorf("failed to parse %s: %w", manifestFileName, err)
+	}
+
+	if manifest.Project != "" && !validProjectName.MatchString(manifest.Project) {
+		return manifest, fmt.Errorf("%s: invalid project name %q: use lowercase letters, digits, dashes and underscores", manifestFileName, manifest.Project)
+	}
+	if manifest.Target == localTargetName {
+		manifest.Target = ""
+	}
+	if manifest.Suspend && manifest.Remove {
+		return manifest, fmt.Errorf("%s: suspend and remove are mutually exclusive", manifestFileName)
+	}
+	if manifest.OnDelete != "" {
+		if _, err := parseDeletePolicy(manifest.OnDelete); err != nil {
+			return manifest, fmt.Errorf("%s: %w", manifestFileName, err)
+		}
+	}
+	return manifest, nil
+}
+
+// deletePolicy returns the policy the manifest asks for, or "" to leave it to
+// the global config.
+func (m stackManifest) deletePolicy() string {
+	if m.Prune != nil && !*m.Prune {
+		return deletePolicyKeep
+	}
+	return m.OnDelete
+}
+
+func parseDeletePolicy(value string) (string, error) {
+	switch value {
+	case deletePolicyDown, deletePolicyDownVolumes, deletePolicyOrphan, deletePolicyKeep:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid deletion policy %q: want down, down-volumes, orphan or keep", value)
+}
+
+// targets reports whether the stack is meant for this instance and the
+// Docker target it is deploying to.
+func (m stackManifest) targets(config Config) bool {
+	if m.Target != config.Target.Name {
+		return false
+	}
+	if len(m.Environments) > 0 && !slices.Contains(m.Environments, config.Environment) {
+		return false
+	}
+	if len(m.Hosts) > 0 && !slices.Contains(m.Hosts, config.HostName) {
+		return false
+	}
+	for key, value := range m.Selector {
+		if hostValue, ok := config.HostLabels[key]; !ok || hostValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// stackMode returns stackModeSuspend or stackModeRemove when a marker file or
+// the manifest takes the stack out of reconciling, and "" otherwise. A broken
+// manifest counts as neither, so the deploy reports the error.
+func stackMode(stackPath string) string {
+	if fileExists(filepath.Join(stackPath, stackModeRemove)) {
+		return stackModeRemove
+	}
+	if fileExists(filepath.Join(stackPath, stackModeSuspend)) || fileExists(filepath.Join(stackPath, stackModeIgnore)) {
+		return stackModeSuspend
+	}
+
+	manifest, err := loadStackManifest(stackPath)
+	switch {
+	case err != nil:
+		return ""
+	case manifest.Remove:
+		return stackModeRemove
+	case manifest.Suspend:
+		return stackModeSuspend
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCurrentStacksModes(t *testing.T) {
+	repoPath := t.TempDir()
+	stacks := map[string]map[string]string{
+		"web":       {},
+		"legacy":    {"ignore": ""},
+		"paused":    {"suspend": ""},
+		"db":        {manifestFileName: "suspend: true\n"},
+		"old":       {"remove": ""},
+		"retired":   {manifestFileName: "remove: true\non_delete: down-volumes\n"},
+		"malformed": {manifestFileName: "suspend: [\n"},
+	}
+	for stackName, files := range stacks {
+		stackPath := filepath.Join(repoPath, stackName)
+		require.NoError(t, os.MkdirAll(stackPath, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(stackPath, "compose.yml"), []byte("services: {}\n"), 0644))
+		for name, content := range files {
+			require.NoError(t, os.WriteFile(filepath.Join(stackPath, name), []byte(content), 0644))
+		}
+	}
+
+	current, suspended, broken, err := getCurrentStacks(Config{RepoPath: repoPath})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]bool{"web": true}, current)
+	assert.Equal(t, map[string]bool{"legacy": true, "paused": true, "db": true}, suspended)
+	assert.Equal(t, []string{"malformed"}, sortedKeys(broken))
+	assert.ErrorContains(t, broken["malformed"], "failed to parse barnacle.yml")
+}
+
+func TestLoadStackManifest(t *testing.T) {
+	tests := []struct {
+		name           string
+		content        string
+		expectedPolicy string
+		expectErr      bool
+	}{
+		{name: "empty", content: "", expectedPolicy: ""},
+		{name: "on_delete", content: "on_delete: orphan\n", expectedPolicy: deletePolicyOrphan},
+		{name: "prune false", content: "prune: false\n", expectedPolicy: deletePolicyKeep},
+		{name: "prune true", content: "prune: true\n", expectedPolicy: ""},
+		{name: "unknown policy", content: "on_delete: destroy\n", expectErr: true},
+		{name: "unknown field", content: "on_delet: keep\n", expectErr: true},
+		{name: "suspend and remove", content: "suspend: true\nremove: true\n", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stackPath := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(stackPath, manifestFileName), []byte(tc.content), 0644))
+
+			manifest, err := loadStackManifest(stackPath)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedPolicy, manifest.deletePolicy())
+		})
+	}
+}
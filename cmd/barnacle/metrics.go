@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	gitFetchBuckets    = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	stackDeployBuckets = []float64{1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+)
+
+// appMetrics is shared by the loop and the API server. Prometheus client
+// libraries are deliberately avoided; the text format below is all we need.
+var appMetrics = newMetrics()
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type metrics struct {
+	mu sync.Mutex
+
+	polls                uint64
+	pollFailures         uint64
+	notificationFailures uint64
+	gitFetchDuration     *histogram
+
+	// Per-stack series are keyed by their target and stack labels, so the
+	// same stack on two Docker targets is two series.
+	stackDeployDuration map[string]*histogram
+	stackDeployFailures map[string]uint64
+	stackLastSuccess    map[string]time.Time
+	stackRemovals       map[string]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		gitFetchDuration:    newHistogram(gitFetchBuckets),
+		stackDeployDuration: make(map[string]*histogram),
+		stackDeployFailures: make(map[string]uint64),
+		stackLastSuccess:    make(map[string]time.Time),
+		stackRemovals:       make(map[string]uint64),
+	}
+}
+
+func (m *metrics) observePoll(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.polls++
+	if err != nil {
+		m.pollFailures++
+	}
+}
+
+func (m *metrics) observeGitFetch(duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gitFetchDuration.observe(duration.Seconds())
+}
+
+func stackSeries(target, stackName string) string {
+	return joinLabels(labelPair("target", target), labelPair("stack", stackName))
+}
+
+func (m *metrics) observeStackDeploy(target, stackName string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series := stackSeries(target, stackName)
+	h := m.stackDeployDuration[series]
+	if h == nil {
+		h = newHistogram(stackDeployBuckets)
+		m.stackDeployDuration[series] = h
+	}
+	h.observe(duration.Seconds())
+
+	if err != nil {
+		m.stackDeployFailures[series]++
+		return
+	}
+	m.stackLastSuccess[series] = time.Now()
+}
+
+// observeStackRemoval counts a compose down of a deleted stack. Successfully
+// removed stacks stop reporting per-stack series so dashboards don't show
+// them forever.
+func (m *metrics) observeStackRemoval(target, stackName string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.stackRemovals["failure"]++
+		return
+	}
+	m.stackRemovals["success"]++
+	series := stackSeries(target, stackName)
+	delete(m.stackDeployDuration, series)
+	delete(m.stackDeployFailures, series)
+	delete(m.stackLastSuccess, series)
+}
+
+func (m *metrics) observeNotificationFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notificationFailures++
+}
+
+// writeTo writes every metric, with the stack gauges summed over the states of
+// all Docker targets. The last sync is the oldest of theirs, so one target
+// falling behind shows.
+func (m *metrics) writeTo(w io.Writer, states []*State) {
+	var lastSync time.Time
+	managedStacks, failingStacks := 0, 0
+	for _, state := range states {
+		state.mu.RLock()
+		if lastSync.IsZero() || (!state.LastSync.IsZero() && state.LastSync.Before(lastSync)) {
+			lastSync = state.LastSync
+		}
+		managedStacks += len(state.DeployedStacks)
+		for stackName, status := range state.Stacks {
+			if state.DeployedStacks[stackName] && status.Status == stackStatusFailed {
+				failingStacks++
+			}
+		}
+		state.mu.RUnlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetric(w, "barnacle_polls_total", "counter", "Repository polls attempted.", "", float64(m.polls))
+	writeMetric(w, "barnacle_poll_failures_total", "counter", "Repository polls that failed.", "", float64(m.pollFailures))
+	writeHistogram(w, "barnacle_git_fetch_duration_seconds", "Time spent fetching from the remote.",
+		map[string]*histogram{"": m.gitFetchDuration})
+
+	if !lastSync.IsZero() {
+		writeMetric(w, "barnacle_last_sync_success_timestamp_seconds", "gauge",
+			"Unix time of the last successful sync.", "", float64(lastSync.Unix()))
+		writeMetric(w, "barnacle_time_since_last_sync_seconds", "gauge",
+			"Seconds since the last successful sync.", "", time.Since(lastSync).Seconds())
+	}
+
+	writeMetric(w, "barnacle_managed_stacks", "gauge", "Stacks currently managed.", "", float64(managedStacks))
+	writeMetric(w, "barnacle_failing_stacks", "gauge", "Managed stacks whose last deploy failed.", "", float64(failingStacks))
+
+	writeHistogram(w, "barnacle_stack_deploy_duration_seconds", "Time spent running compose up per stack.",
+		m.stackDeployDuration)
+
+	fmt.Fprintf(w, "# HELP barnacle_stack_deploy_failures_total Failed deploys per stack.\n")
+	fmt.Fprintf(w, "# TYPE barnacle_stack_deploy_failures_total counter\n")
+	for _, series := range sortedKeys(m.stackDeployFailures) {
+		writeSample(w, "barnacle_stack_deploy_failures_total", series, float64(m.stackDeployFailures[series]))
+	}
+
+	fmt.Fprintf(w, "# HELP barnacle_stack_last_success_timestamp_seconds Unix time of the last successful deploy per stack.\n")
+	fmt.Fprintf(w, "# TYPE barnacle_stack_last_success_timestamp_seconds gauge\n")
+	for _, series := range sortedKeys(m.stackLastSuccess) {
+		writeSample(w, "barnacle_stack_last_success_timestamp_seconds", series, float64(m.stackLastSuccess[series].Unix()))
+	}
+
+	fmt.Fprintf(w, "# HELP barnacle_stack_removals_total Compose down runs for deleted stacks.\n")
+	fmt.Fprintf(w, "# TYPE barnacle_stack_removals_total counter\n")
+	for _, result := range sortedKeys(m.stackRemovals) {
+		writeSample(w, "barnacle_stack_removals_total", labelPair("result", result), float64(m.stackRemovals[result]))
+	}
+
+	writeMetric(w, "barnacle_notification_failures_total", "counter", "Notifications that could not be delivered.", "", float64(m.notificationFailures))
+}
+
+func (s *apiServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	states := make([]*State, 0, len(s.targets))
+	for _, t := range s.targets {
+		states = append(states, t.state)
+	}
+	appMetrics.writeTo(w, states)
+}
+
+func writeMetric(w io.Writer, name, kind, help, labels string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	writeSample(w, name, labels, value)
+}
+
+// writeHistogram writes one histogram per key of histograms, which holds its
+// labels.
+func writeHistogram(w io.Writer, name, help string, histograms map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	for _, labels := range sortedKeys(histograms) {
+		h := histograms[labels]
+
+		for i, bound := range h.buckets {
+			writeSample(w, name+"_bucket", joinLabels(labels, labelPair("le", formatFloat(bound))), float64(h.counts[i]))
+		}
+		writeSample(w, name+"_bucket", joinLabels(labels, labelPair("le", "+Inf")), float64(h.count))
+		writeSample(w, name+"_sum", labels, h.sum)
+		writeSample(w, name+"_count", labels, float64(h.count))
+	}
+}
+
+func writeSample(w io.Writer, name, labels string, value float64) {
+	if labels != "" {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(value))
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func labelPair(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+	return fmt.Sprintf(`%s="%s"`, name, value)
+}
+
+func joinLabels(labels ...string) string {
+	nonEmpty := labels[:0:0]
+	for _, l := range labels {
+		if l != "" {
+			nonEmpty = append(nonEmpty, l)
+		}
+	}
+	return strings.Join(nonEmpty, ",")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
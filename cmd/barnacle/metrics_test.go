@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := newMetrics()
+	m.observePoll(nil)
+	m.observePoll(errors.New("fetch failed"))
+	m.observeStackDeploy("local", "web", 3*time.Second, nil)
+	m.observeStackDeploy("nas", "web", 30*time.Second, errors.New("boom"))
+	m.observeStackDeploy("local", `we"ird`, 200*time.Second, errors.New("boom"))
+	m.observeNotificationFailure()
+
+	local := newState()
+	local.DeployedStacks = map[string]bool{"web": true, `we"ird`: true}
+	local.Stacks[`we"ird`] = &StackStatus{Name: `we"ird`, Status: stackStatusFailed}
+	nas := newState()
+	nas.DeployedStacks = map[string]bool{"web": true}
+	nas.Stacks["web"] = &StackStatus{Name: "web", Status: stackStatusFailed}
+
+	var out strings.Builder
+	m.writeTo(&out, []*State{local, nas})
+	text := out.String()
+
+	assert.Contains(t, text, "barnacle_polls_total 2\n")
+	assert.Contains(t, text, "barnacle_poll_failures_total 1\n")
+	assert.Contains(t, text, `barnacle_stack_deploy_duration_seconds_bucket{target="local",stack="web",le="2.5"} 0`+"\n")
+	assert.Contains(t, text, `barnacle_stack_deploy_duration_seconds_bucket{target="local",stack="web",le="5"} 1`+"\n")
+	assert.Contains(t, text, `barnacle_stack_deploy_duration_seconds_count{target="local",stack="web"} 1`+"\n")
+	assert.Contains(t, text, `barnacle_stack_deploy_duration_seconds_count{target="nas",stack="web"} 1`+"\n")
+	assert.Contains(t, text, `barnacle_stack_deploy_failures_total{target="nas",stack="web"} 1`+"\n")
+	assert.Contains(t, text, `barnacle_stack_deploy_failures_total{target="local",stack="we\"ird"} 1`+"\n")
+	assert.NotContains(t, text, `barnacle_stack_deploy_failures_total{target="local",stack="web"}`)
+	assert.Contains(t, text, "barnacle_managed_stacks 3\n")
+	assert.Contains(t, text, "barnacle_failing_stacks 2\n")
+	assert.Contains(t, text, "barnacle_notification_failures_total 1\n")
+	assert.NotContains(t, text, "barnacle_last_sync_success_timestamp_seconds")
+}
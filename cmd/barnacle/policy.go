@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy rules a stack's resolved compose config is checked against.
+const (
+	ruleAll            = "all"
+	rulePrivileged     = "privileged"
+	ruleHostNetwork    = "host_network"
+	ruleDockerSocket   = "docker_socket"
+	ruleHostPaths      = "host_paths"
+	ruleCapAdd         = "cap_add"
+	ruleRegistries     = "registries"
+	ruleResourceLimits = "resource_limits"
+)
+
+var policyRules = []string{rulePrivileged, ruleHostNetwork, ruleDockerSocket, ruleHostPaths, ruleCapAdd, ruleRegistries, ruleResourceLimits}
+
+// deployPolicy is what stacks may ask of the host. It lives in POLICY_FILE on
+// the host rather than in the repo, so a push cannot grant itself an
+// exemption.
+type deployPolicy struct {
+	// Deny lists the rules to enforce.
+	Deny []string `yaml:"deny"`
+	// AllowedHostPaths may be bind mounted under host_paths; the checkout
+	// itself always may.
+	AllowedHostPaths []string `yaml:"allowed_host_paths"`
+	// AllowedRegistries are image prefixes such as ghcr.io/acme or
+	// docker.io/library.
+	AllowedRegistries   []string `yaml:"allowed_registries"`
+	AllowedCapabilities []string `yaml:"allowed_capabilities"`
+	// Exemptions maps stack names or path.Match patterns to the rules they
+	// are exempt from, or all.
+	Exemptions map[string][]string `yaml:"exemptions"`
+}
+
+// policyError is a stack refused for breaking the deploy policy.
+type policyError struct {
+	violations []string
+}
+
+func (e *policyError) Error() string {
+	return "policy violation: " + strings.Join(e.violations, "; ")
+}
+
+func loadPolicy(policyPath string) (deployPolicy, error) {
+	var policy deployPolicy
+	if policyPath == "" {
+		return policy, nil
+	}
+
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return policy, fmt.Errorf("failed to read POLICY_FILE: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&policy); err != nil && !errors.Is(err, io.EOF) {
+		return policy, fmt.Errorf("failed to parse POLICY_FILE %s: %w", policyPath, err)
+	}
+
+	for _, rule := range policy.Deny {
+		if !slices.Contains(policyRules, rule) {
+			return policy, fmt.Errorf("POLICY_FILE: unknown rule %q in deny: want %s", rule, strings.Join(policyRules, ", "))
+		}
+	}
+	for pattern, rules := range policy.Exemptions {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return policy, fmt.Errorf("POLICY_FILE: invalid exemption pattern %q: %w", pattern, err)
+		}
+		for _, rule := range rules {
+			if rule != ruleAll && !slices.Contains(policyRules, rule) {
+				return policy, fmt.Errorf("POLICY_FILE: unknown rule %q in exemptions for %s", rule, pattern)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// rulesFor returns the rules enforced for a stack once its exemptions are
+// taken out.
+func (p deployPolicy) rulesFor(stackName string) []string {
+	rules := slices.Clone(p.Deny)
+	for pattern, exempt := range p.Exemptions {
+		if matched, _ := path.Match(pattern, stackName); !matched {
+			continue
+		}
+		if slices.Contains(exempt, ruleAll) {
+			return nil
+		}
+		rules = slices.DeleteFunc(rules, func(rule string) bool { return slices.Contains(exempt, rule) })
+	}
+	return rules
+}
+
+// enforcePolicy resolves the project's compose config and checks it against
+// the policy, returning a *policyError for a stack that breaks it.
+func enforcePolicy(ctx context.Context, config Config, project composeProject) error {
+	rules := config.Policy.rulesFor(project.stack)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	resolved, err := composeConfig(cmdCtx, project)
+	if err != nil {
+		return err
+	}
+	violations, err := checkPolicy(config.Policy, rules, config.RepoPath, project.workDir(), resolved)
+	if err != nil {
+		return fmt.Errorf("failed to check policy: %w", err)
+	}
+	if len(violations) > 0 {
+		return &policyError{violations: violations}
+	}
+	return nil
+}
+
+// checkPolicy lists how a resolved compose config breaks the given rules.
+// Bind mounts inside repoPath are the stack's own files and always allowed;
+// relative ones are resolved against stackDir. Named volumes the local driver
+// binds to a host directory count as bind mounts of that directory.
+func checkPolicy(policy deployPolicy, rules []string, repoPath, stackDir string, resolved []byte) ([]string, error) {
+	var compose struct {
+		Services map[string]struct {
+			Image       string   `yaml:"image"`
+			Privileged  bool     `yaml:"privileged"`
+			NetworkMode string   `yaml:"network_mode"`
+			CapAdd      []string `yaml:"cap_add"`
+			Volumes     []any    `yaml:"volumes"`
+			MemLimit    any      `yaml:"mem_limit"`
+			Deploy      struct {
+				Resources struct {
+					Limits struct {
+						Memory any `yaml:"memory"`
+					} `yaml:"limits"`
+				} `yaml:"resources"`
+			} `yaml:"deploy"`
+		} `yaml:"services"`
+		Volumes map[string]struct {
+			Driver     string            `yaml:"driver"`
+			DriverOpts map[string]string `yaml:"driver_opts"`
+		} `yaml:"volumes"`
+	}
+	if err := yaml.Unmarshal(resolved, &compose); err != nil {
+		return nil, err
+	}
+
+	enforced := func(rule string) bool { return slices.Contains(rules, rule) }
+
+	allowedPaths := append([]string{repoPath}, policy.AllowedHostPaths...)
+	if linkedRepo, err := resolveHostPath(repoPath); err == nil && linkedRepo != filepath.Clean(repoPath) {
+		allowedPaths = append(allowedPaths, linkedRepo)
+	}
+
+	var violations []string
+	// checkBind checks a host path a container gets. Paths in the checkout
+	// are followed through symlinks first, so a link pushed to the repo
+	// cannot point a mount elsewhere.
+	checkBind := func(source string, violate func(format string, args ...any)) {
+		if !enforced(ruleDockerSocket) && !enforced(ruleHostPaths) {
+			return
+		}
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(stackDir, source)
+		}
+		source = filepath.Clean(source)
+		shown := source
+		if pathWithin(source, []string{repoPath}) {
+			linked, err := resolveHostPath(source)
+			if err != nil {
+				violate("mounts %s, which cannot be resolved: %v", source, err)
+				return
+			}
+			if linked != source {
+				shown = fmt.Sprintf("%s (linked from %s)", linked, source)
+				source = linked
+			}
+		}
+		switch {
+		case isDockerSocket(source):
+			if enforced(ruleDockerSocket) {
+				violate("mounts the container runtime socket %s", shown)
+			}
+		case enforced(ruleHostPaths) && !pathWithin(source, allowedPaths):
+			violate("mounts host path %s", shown)
+		}
+	}
+
+	for _, name := range sortedKeys(compose.Volumes) {
+		volume := compose.Volumes[name]
+		if volume.Driver != "" && volume.Driver != "local" {
+			continue
+		}
+		if !slices.Contains(strings.Split(volume.DriverOpts["o"], ","), "bind") || volume.DriverOpts["device"] == "" {
+			continue
+		}
+		checkBind(volume.DriverOpts["device"], func(format string, args ...any) {
+			violations = append(violations, fmt.Sprintf("volume %s: ", name)+fmt.Sprintf(format, args...))
+		})
+	}
+	for _, name := range sortedKeys(compose.Services) {
+		service := compose.Services[name]
+		violate := func(format string, args ...any) {
+			violations = append(violations, fmt.Sprintf("service %s: ", name)+fmt.Sprintf(format, args...))
+		}
+
+		if enforced(rulePrivileged) && service.Privileged {
+			violate("privileged")
+		}
+		if enforced(ruleHostNetwork) && service.NetworkMode == "host" {
+			violate("host network")
+		}
+		if enforced(ruleCapAdd) {
+			for _, capability := range service.CapAdd {
+				if !slices.Contains(policy.AllowedCapabilities, strings.TrimPrefix(capability, "CAP_")) {
+					violate("cap_add %s", capability)
+				}
+			}
+		}
+		if enforced(ruleRegistries) && service.Image != "" && !imageAllowed(service.Image, policy.AllowedRegistries) {
+			violate("image %s is not from an allowed registry", service.Image)
+		}
+		if enforced(ruleResourceLimits) && service.MemLimit == nil && service.Deploy.Resources.Limits.Memory == nil {
+			violate("no memory limit")
+		}
+
+		for _, source := range bindSources(service.Volumes) {
+			checkBind(source, violate)
+		}
+	}
+	return violations, nil
+}
+
+// bindSources returns the host side of a service's bind mounts, from the long
+// form compose config resolves them to or the short form some compose
+// implementations keep.
+func bindSources(volumes []any) []string {
+	var sources []string
+	for _, volume := range volumes {
+		switch v := volume.(type) {
+		case string:
+			if source, _, ok := strings.Cut(v, ":"); ok && (strings.HasPrefix(source, "/") || strings.HasPrefix(source, ".")) {
+				sources = append(sources, source)
+			}
+		case map[string]any:
+			if source, ok := v["source"].(string); ok && v["type"] == "bind" {
+				sources = append(sources, source)
+			}
+		}
+	}
+	return sources
+}
+
+// resolveHostPath follows the symlinks in an absolute path one component at
+// a time, so a link is followed even when its target does not exist here.
+// The part of the path that does not exist yet cannot be a link, and is left
+// for the runtime to create.
+func resolveHostPath(path string) (string, error) {
+	links := 0
+	var resolve func(path string) (string, error)
+	resolve = func(path string) (string, error) {
+		resolved := string(filepath.Separator)
+		parts := strings.Split(strings.TrimPrefix(filepath.Clean(path), string(filepath.Separator)), string(filepath.Separator))
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			next := filepath.Join(resolved, part)
+			info, err := os.Lstat(next)
+			if errors.Is(err, os.ErrNotExist) {
+				return filepath.Join(append([]string{resolved}, parts[i:]...)...), nil
+			}
+			if err != nil {
+				return "", err
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				resolved = next
+				continue
+			}
+
+			if links++; links > 40 {
+				return "", fmt.Errorf("too many links in %s", path)
+			}
+			target, err := os.Readlink(next)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(resolved, target)
+			}
+			if resolved, err = resolve(target); err != nil {
+				return "", err
+			}
+		}
+		return resolved, nil
+	}
+	return resolve(path)
+}
+
+func isDockerSocket(source string) bool {
+	base := filepath.Base(source)
+	return base == "docker.sock" || base == "podman.sock"
+}
+
+func pathWithin(source string, allowed []string) bool {
+	source = filepath.Clean(source)
+	for _, dir := range allowed {
+		if dir == "" {
+			continue
+		}
+		dir = filepath.Clean(dir)
+		if source == dir || strings.HasPrefix(source, dir+string(filepath.Separator)) || dir == string(filepath.Separator) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageAllowed reports whether image, normalised the way Docker does so that
+// nginx is docker.io/library/nginx, starts with one of the allowed prefixes.
+func imageAllowed(image string, allowed []string) bool {
+	name, _, _ := strings.Cut(image, "@")
+	first, rest, hasSlash := strings.Cut(name, "/")
+	if !hasSlash || (!strings.ContainsAny(first, ".:") && first != "localhost") {
+		if !hasSlash {
+			name = "library/" + name
+		}
+		name = "docker.io/" + name
+	} else if first == "index.docker.io" {
+		name = "docker.io/" + rest
+	}
+
+	for _, prefix := range allowed {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if name == prefix || strings.HasPrefix(name, prefix+"/") || strings.HasPrefix(name, prefix+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// composeConfig returns the project's compose config with every file, env
+// file and profile applied, as compose would run it.
+func composeConfig(ctx context.Context, project composeProject) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := project.command(ctx, append(project.args(), "config")...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to resolve compose config: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
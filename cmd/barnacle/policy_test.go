@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const resolvedCompose = `
+services:
+  app:
+    image: ghcr.io/acme/app:1.2
+    cap_add: [NET_BIND_SERVICE]
+    volumes:
+      - type: bind
+        source: /opt/stacks/web/config
+        target: /config
+      - type: volume
+        source: data
+        target: /data
+    deploy:
+      resources:
+        limits:
+          memory: "268435456"
+  proxy:
+    image: traefik:v3
+    privileged: true
+    network_mode: host
+    cap_add: [SYS_ADMIN]
+    volumes:
+      - /var/run/docker.sock:/var/run/docker.sock:ro
+      - /etc:/host/etc:ro
+      - /srv/media:/media
+      - ./static:/static
+      - ../../../etc/ssl:/ssl
+`
+
+func TestCheckPolicy(t *testing.T) {
+	policy := deployPolicy{
+		AllowedHostPaths:    []string{"/srv"},
+		AllowedRegistries:   []string{"ghcr.io/acme"},
+		AllowedCapabilities: []string{"NET_BIND_SERVICE"},
+	}
+
+	tests := []struct {
+		name     string
+		rules    []string
+		expected []string
+	}{
+		{name: "no rules"},
+		{
+			name:  "every rule",
+			rules: policyRules,
+			expected: []string{
+				"service proxy: privileged",
+				"service proxy: host network",
+				"service proxy: cap_add SYS_ADMIN",
+				"service proxy: image traefik:v3 is not from an allowed registry",
+				"service proxy: no memory limit",
+				"service proxy: mounts the container runtime socket /var/run/docker.sock",
+				"service proxy: mounts host path /etc",
+				"service proxy: mounts host path /etc/ssl",
+			},
+		},
+		{
+			name:     "socket only",
+			rules:    []string{ruleDockerSocket},
+			expected: []string{"service proxy: mounts the container runtime socket /var/run/docker.sock"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			violations, err := checkPolicy(policy, tc.rules, "/opt/stacks", "/opt/stacks/proxy", []byte(resolvedCompose))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, violations)
+		})
+	}
+}
+
+func TestCheckPolicyFollowsLinksAndVolumes(t *testing.T) {
+	repoPath := t.TempDir()
+	stackDir := filepath.Join(repoPath, "web")
+	require.NoError(t, os.MkdirAll(filepath.Join(stackDir, "config"), 0755))
+	require.NoError(t, os.Symlink("/nowhere/docker.sock", filepath.Join(stackDir, "sock")))
+	require.NoError(t, os.Symlink("/etc", filepath.Join(stackDir, "etc")))
+	require.NoError(t, os.Symlink("config", filepath.Join(stackDir, "settings")))
+	require.NoError(t, os.Symlink("loop", filepath.Join(stackDir, "loop")))
+
+	resolved := `
+services:
+  app:
+    volumes:
+      - ./sock:/var/run/docker.sock
+      - ./etc/ssl:/ssl
+      - ./settings:/config
+      - ./cache/new:/cache
+      - ./loop:/loop
+volumes:
+  host:
+    driver_opts: {type: none, o: bind, device: /etc}
+  own:
+    driver: local
+    driver_opts: {type: none, o: "bind,ro", device: ` + stackDir + `/config}
+  tmpfs:
+    driver_opts: {type: tmpfs, device: tmpfs}
+`
+	violations, err := checkPolicy(deployPolicy{}, []string{ruleDockerSocket, ruleHostPaths}, repoPath, stackDir, []byte(resolved))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"volume host: mounts host path /etc",
+		"service app: mounts the container runtime socket /nowhere/docker.sock (linked from " + filepath.Join(stackDir, "sock") + ")",
+		"service app: mounts host path /etc/ssl (linked from " + filepath.Join(stackDir, "etc/ssl") + ")",
+		"service app: mounts " + filepath.Join(stackDir, "loop") + ", which cannot be resolved: too many links in " + filepath.Join(stackDir, "loop"),
+	}, violations)
+}
+
+func TestImageAllowed(t *testing.T) {
+	allowed := []string{"docker.io/library", "ghcr.io/acme", "registry.local:5000"}
+
+	tests := []struct {
+		image    string
+		expected bool
+	}{
+		{image: "nginx", expected: true},
+		{image: "nginx:1.27", expected: true},
+		{image: "docker.io/library/redis@sha256:abc", expected: true},
+		{image: "traefik/whoami", expected: false},
+		{image: "ghcr.io/acme/app:1", expected: true},
+		{image: "ghcr.io/acme-evil/app:1", expected: false},
+		{image: "registry.local:5000/app", expected: true},
+		{image: "quay.io/prometheus/node-exporter", expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.image, func(t *testing.T) {
+			assert.Equal(t, tc.expected, imageAllowed(tc.image, allowed))
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "policy.yml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	policy, err := loadPolicy(write("deny: [privileged, docker_socket, host_network]\nexemptions:\n  traefik: [docker_socket]\n  monitoring/*: [all]\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{rulePrivileged, ruleHostNetwork}, policy.rulesFor("traefik"))
+	assert.Empty(t, policy.rulesFor("monitoring/node-exporter"))
+	assert.Equal(t, []string{rulePrivileged, ruleDockerSocket, ruleHostNetwork}, policy.rulesFor("web"))
+
+	_, err = loadPolicy(write("deny: [root]\n"))
+	assert.Error(t, err)
+	_, err = loadPolicy(write("denied: [privileged]\n"))
+	assert.Error(t, err)
+
+	policy, err = loadPolicy("")
+	require.NoError(t, err)
+	assert.Empty(t, policy.rulesFor("web"))
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const (
+	triggerSync          = "sync"
+	triggerRedeployStack = "redeploy"
+	triggerRedeployAll   = "redeploy-all"
+	triggerConfirmDelete = "confirm-deletion"
+	triggerClearDegraded = "clear-degraded"
+)
+
+var (
+	errUnknownStack = errors.New("unknown stack")
+	errRepoNotReady = errors.New("repository has no content yet")
+	errSuspended    = errors.New("stack is suspended")
+	errNotDegraded  = errors.New("no target has a degraded state")
+)
+
+// trigger is a request to reconcile, from the ticker, startup or the API. API
+// triggers are handed to the main loop so they run on the same goroutine as
+// the ticker and never overlap a poll.
+type trigger struct {
+	kind   string
+	source string
+	stack  string
+	// target limits a trigger to one Docker target where that applies.
+	target string
+	done   chan triggerResult
+}
+
+type triggerResult struct {
+	results map[string]error
+	err     error
+}
+
+func (t trigger) describe() string {
+	if t.stack != "" {
+		return t.kind + " " + t.stack
+	}
+	return t.kind
+}
+
+// reconciler deploys the repository to each Docker target in turn. The local
+// target always comes first; every target keeps its own state.
+type reconciler struct {
+	config  Config
+	targets []*deployTarget
+	repo    *git.Repository
+	audit   *auditLog
+
+	// refusedCommit is the last commit refused for its signature, so the
+	// alert goes out once rather than on every poll.
+	refusedCommit string
+}
+
+func (r *reconciler) labels() stackLabels {
+	return stackLabels{
+		instance: r.config.InstanceID,
+		repo:     r.config.RepoURL,
+		commit:   headCommit(r.repo),
+	}
+}
+
+// notifyResults sends the deployment result for a target, signed with this
+// instance's identity and the stacks it owns there, since several instances
+// and targets may share a channel. Remote targets with nothing to report stay
+// quiet.
+func (r *reconciler) notifyResults(t *deployTarget, results map[string]error, changedFiles []string) {
+	if t.docker.Name != "" && len(results) == 0 {
+		return
+	}
+
+	t.state.mu.RLock()
+	owned := sortedKeys(t.state.DeployedStacks)
+	t.state.mu.RUnlock()
+
+	footer := fmt.Sprintf("%s owns %d stacks", r.config.forTarget(t.docker).identity(), len(owned))
+	if len(owned) > 0 {
+		footer += ": " + strings.Join(owned, ", ")
+	}
+	if len(footer) > 2000 {
+		footer = footer[:1997] + "..."
+	}
+	sendDeploymentResultWebhook(r.config.DiscordWebhook, results, changedFiles, footer)
+}
+
+// alertRefused sends an alert the first time a commit is refused for its
+// signature.
+func (r *reconciler) alertRefused(err error) {
+	var untrusted *untrustedCommitError
+	if !errors.As(err, &untrusted) || untrusted.commit == r.refusedCommit {
+		return
+	}
+	r.refusedCommit = untrusted.commit
+	sendAlertWebhook(r.config.DiscordWebhook, "🔏 Commit Refused",
+		fmt.Sprintf("Barnacle will not deploy %s because it does not carry a trusted signature. Nothing from it is deployed until a trusted commit is pushed on top.", shortHash(untrusted.commit)),
+		untrusted.Error())
+}
+
+// recordSync records a pull on every target, since they all follow the same
+// checkout.
+func (r *reconciler) recordSync(commit string, err error) {
+	for _, t := range r.targets {
+		t.state.recordSync(commit, err)
+	}
+}
+
+// deployedCommit returns the commit the targets were last fully deployed at,
+// or the zero hash when none was recorded. It reports false when targets were
+// left at different commits, so no single diff covers them all.
+func (r *reconciler) deployedCommit() (plumbing.Hash, bool) {
+	var commit string
+	for i, t := range r.targets {
+		deployed := t.state.deployedCommit()
+		if i > 0 && deployed != commit {
+			return plumbing.ZeroHash, false
+		}
+		commit = deployed
+	}
+	if commit == "" {
+		return plumbing.ZeroHash, true
+	}
+	return plumbing.NewHash(commit), true
+}
+
+// finishTarget records and announces a target's part of a pass and folds its
+// results into the combined ones.
+func (r *reconciler) finishTarget(t *deployTarget, targetResults map[string]error, changedFiles []string, notify bool, results map[string]error) {
+	t.state.recordDeployment(headCommit(r.repo), targetResults)
+	saveStateOrWarn(t.state)
+	if notify {
+		r.notifyResults(t, targetResults, changedFiles)
+	}
+	for key, err := range targetResults {
+		results[targetResultKey(t.docker, key)] = err
+	}
+}
+
+// handle runs a trigger and writes it to the audit log. Polls that found
+// nothing to do are left out so the log only holds passes that did something.
+func (r *reconciler) handle(ctx context.Context, t trigger) triggerResult {
+	started := time.Now()
+	fromCommit := headCommit(r.repo)
+
+	result := r.dispatch(ctx, t)
+
+	idle := len(result.results) == 0 && (result.err == nil || errors.Is(result.err, errRepoNotReady))
+	if t.source != sourcePoll || !idle {
+		record := newAuditRecord(t, fromCommit, headCommit(r.repo), started, result)
+		if err := r.audit.append(record); err != nil {
+			slog.Warn("Failed to write audit log", "error", err)
+		}
+	}
+
+	return result
+}
+
+func (r *reconciler) dispatch(ctx context.Context, t trigger) triggerResult {
+	switch t.kind {
+	case triggerSync:
+		return r.sync(ctx)
+	case triggerRedeployStack:
+		return r.redeployStack(ctx, t.stack)
+	case triggerRedeployAll:
+		if r.repo == nil {
+			return triggerResult{err: errRepoNotReady}
+		}
+		return r.deployAll(ctx, t.source != sourceStartup)
+	case triggerConfirmDelete:
+		if r.repo == nil {
+			return triggerResult{err: errRepoNotReady}
+		}
+		return r.confirmDeletion(ctx)
+	case triggerClearDegraded:
+		return r.clearDegraded(t.target)
+	}
+	return triggerResult{err: fmt.Errorf("unknown trigger %q", t.kind)}
+}
+
+func (r *reconciler) sync(ctx context.Context) triggerResult {
+	if r.repo == nil {
+		repo, err := initializeRepo(ctx, r.config)
+		appMetrics.observePoll(err)
+		if err != nil {
+			slog.Error("Failed to initialize repository", "phase", "sync", "error", err)
+			r.recordSync("", err)
+			return triggerResult{err: err}
+		}
+		if repo == nil {
+			return triggerResult{err: errRepoNotReady}
+		}
+		r.repo = repo
+		appHealth.setRepoReady(true)
+		slog.Info("Repository now has content, performing initial deployment", "phase", "sync", "commit", shortHash(headCommit(repo)))
+		return r.deployAll(ctx, false)
+	}
+
+	deployed, agreed := r.deployedCommit()
+	update, err := pullRepo(ctx, r.repo, r.config, deployed)
+	appMetrics.observePoll(err)
+	if err != nil {
+		slog.Error("Failed to pull repository", "phase", "sync", "error", err)
+		r.recordSync("", err)
+		r.alertRefused(err)
+		return triggerResult{err: err}
+	}
+	r.recordSync(headCommit(r.repo), nil)
+
+	if update == nil {
+		slog.Info("No updates found", "phase", "sync")
+		return triggerResult{results: map[string]error{}}
+	}
+
+	slog.Info("Repository updated, deploying changed stacks", "phase", "sync", "commit", shortHash(headCommit(r.repo)))
+
+	sendUpdateDetectedWebhook(r.config.DiscordWebhook, update)
+
+	if !agreed {
+		slog.Warn("Targets were left at different commits, deploying all stacks", "phase", "sync")
+		update.changedFiles, update.renamedFiles = nil, nil
+	}
+
+	results := make(map[string]error)
+	for _, t := range r.targets {
+		targetResults := make(map[string]error)
+		if err := deployChanges(ctx, r.config.forTarget(t.docker), update.changedFiles, update.renamedFiles, r.labels(), t.state, targetResults); err != nil {
+			slog.Error("Failed to deploy stacks", "phase", "deploy", "target", t.docker.displayName(), "error", err)
+		} else if ctx.Err() == nil {
+			t.state.recordDeployedCommit(update.to.String())
+		}
+		r.finishTarget(t, targetResults, update.changedFiles, true, results)
+	}
+	return triggerResult{results: results}
+}
+
+func (r *reconciler) deployAll(ctx context.Context, notify bool) triggerResult {
+	if err := verifyCommits(r.repo, plumbing.ZeroHash, plumbing.NewHash(headCommit(r.repo)), r.config); err != nil {
+		slog.Error("Refusing to deploy checked out commit", "phase", "deploy", "error", err)
+		r.recordSync("", err)
+		r.alertRefused(err)
+		return triggerResult{err: err}
+	}
+	r.recordSync(headCommit(r.repo), nil)
+
+	results := make(map[string]error)
+	var deployErr error
+	for _, t := range r.targets {
+		targetResults := make(map[string]error)
+		if err := deployAllStacks(ctx, r.config.forTarget(t.docker), r.labels(), t.state, targetResults); err != nil {
+			slog.Error("Failed to deploy stacks", "phase", "deploy", "target", t.docker.displayName(), "error", err)
+			deployErr = cmp.Or(deployErr, fmt.Errorf("%s: %w", t.docker.displayName(), err))
+		} else if ctx.Err() == nil {
+			t.state.recordDeployedCommit(headCommit(r.repo))
+		}
+		r.finishTarget(t, targetResults, nil, notify, results)
+	}
+	return triggerResult{results: results, err: deployErr}
+}
+
+// redeployStack redeploys a stack on whichever target it is meant for.
+func (r *reconciler) redeployStack(ctx context.Context, stackName string) triggerResult {
+	if r.repo == nil {
+		return triggerResult{err: errRepoNotReady}
+	}
+
+	for _, t := range r.targets {
+		config := r.config.forTarget(t.docker)
+		currentStacks, suspendedStacks, brokenStacks, err := getCurrentStacks(config)
+		if err != nil {
+			return triggerResult{err: err}
+		}
+		if err := brokenStacks[stackName]; err != nil {
+			return triggerResult{results: map[string]error{stackName: err}}
+		}
+		if suspendedStacks[stackName] {
+			return triggerResult{err: fmt.Errorf("%w: %s", errSuspended, stackName)}
+		}
+		if !currentStacks[stackName] {
+			continue
+		}
+
+		targetResults := make(map[string]error)
+		deployStacks(ctx, config, map[string]bool{stackName: true}, r.labels(), t.state, targetResults)
+
+		results := make(map[string]error)
+		r.finishTarget(t, targetResults, nil, true, results)
+		return triggerResult{results: results}
+	}
+	return triggerResult{err: fmt.Errorf("%w: %s", errUnknownStack, stackName)}
+}
+
+// clearDegraded lets removals go ahead again on the named target, or on every
+// target, after an operator has checked what is deployed there.
+func (r *reconciler) clearDegraded(targetName string) triggerResult {
+	results := make(map[string]error)
+	for _, t := range r.targets {
+		if targetName != "" && t.docker.displayName() != targetName {
+			continue
+		}
+		if t.state.clearDegraded() {
+			slog.Warn("Degraded state cleared, stack removals are allowed again", "target", t.docker.displayName())
+			saveStateOrWarn(t.state)
+			results[t.docker.displayName()] = nil
+		}
+	}
+	if len(results) == 0 {
+		return triggerResult{err: errNotDegraded}
+	}
+	return triggerResult{results: results}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Kinds of DEPLOY_REF. branch follows the tip of BRANCH; the others pin the
+// checkout and move only when the pin, or for semver the set of tags,
+// changes.
+const (
+	refBranch = "branch"
+	refTag    = "tag"
+	refSemver = "semver"
+	refCommit = "commit"
+)
+
+// refPolicy decides which commit is deployed.
+type refPolicy struct {
+	kind     string
+	value    string
+	versions versionRange
+}
+
+// parseRefPolicy reads DEPLOY_REF: branch, tag:v1.4.2, semver:v1.* or
+// semver:>=1.2.0 <2.0.0, or commit:<sha>.
+func parseRefPolicy(value string) (refPolicy, error) {
+	if value == "" || value == refBranch {
+		return refPolicy{kind: refBranch}, nil
+	}
+
+	kind, ref, ok := strings.Cut(value, ":")
+	ref = strings.TrimSpace(ref)
+	if !ok || ref == "" {
+		return refPolicy{}, fmt.Errorf("invalid DEPLOY_REF %q: want branch, tag:<name>, semver:<range> or commit:<sha>", value)
+	}
+
+	policy := refPolicy{kind: kind, value: ref}
+	switch kind {
+	case refTag:
+	case refSemver:
+		versions, err := parseVersionRange(ref)
+		if err != nil {
+			return refPolicy{}, fmt.Errorf("invalid DEPLOY_REF range %q: %w", ref, err)
+		}
+		policy.versions = versions
+	case refCommit:
+		if len(ref) < 7 || strings.Trim(strings.ToLower(ref), "0123456789abcdef") != "" {
+			return refPolicy{}, fmt.Errorf("invalid DEPLOY_REF commit %q: want at least 7 hex digits", ref)
+		}
+	default:
+		return refPolicy{}, fmt.Errorf("invalid DEPLOY_REF kind %q: want branch, tag, semver or commit", kind)
+	}
+	return policy, nil
+}
+
+func (p refPolicy) pinned() bool {
+	return p.kind != refBranch && p.kind != ""
+}
+
+func (p refPolicy) String() string {
+	if !p.pinned() {
+		return refBranch
+	}
+	return p.kind + ":" + p.value
+}
+
+// resolveRef finds the commit a pinned policy points at among the fetched
+// tags and commits, and a name for it such as the tag.
+func resolveRef(repo *git.Repository, policy refPolicy) (plumbing.Hash, string, error) {
+	switch policy.kind {
+	case refTag:
+		hash, err := tagCommit(repo, plumbing.NewTagReferenceName(policy.value))
+		if err != nil {
+			return plumbing.ZeroHash, "", fmt.Errorf("tag %s: %w", policy.value, err)
+		}
+		return hash, policy.value, nil
+	case refSemver:
+		return newestMatchingTag(repo, policy.versions)
+	case refCommit:
+		hash, err := repo.ResolveRevision(plumbing.Revision(policy.value))
+		if err != nil {
+			return plumbing.ZeroHash, "", fmt.Errorf("commit %s: %w", policy.value, err)
+		}
+		return *hash, shortHash(hash.String()), nil
+	}
+	return plumbing.ZeroHash, "", fmt.Errorf("DEPLOY_REF %s does not pin a commit", policy)
+}
+
+// tagCommit peels a lightweight or annotated tag to its commit.
+func tagCommit(repo *git.Repository, name plumbing.ReferenceName) (plumbing.Hash, error) {
+	ref, err := repo.Reference(name, true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	tag, err := repo.TagObject(ref.Hash())
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return ref.Hash(), nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	commit, err := tag.Commit()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return commit.Hash, nil
+}
+
+func newestMatchingTag(repo *git.Repository, versions versionRange) (plumbing.Hash, string, error) {
+	tags, err := repo.Tags()
+	if err != nil {
+		return plumbing.ZeroHash, "", err
+	}
+
+	var newest *semver
+	var newestName plumbing.ReferenceName
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		version, ok := parseSemver(ref.Name().Short())
+		if ok && versions.matches(version) && (newest == nil || version.compare(*newest) > 0) {
+			newest, newestName = &version, ref.Name()
+		}
+		return nil
+	})
+	if err != nil {
+		return plumbing.ZeroHash, "", err
+	}
+	if newest == nil {
+		return plumbing.ZeroHash, "", fmt.Errorf("no tag matches %s", versions)
+	}
+
+	hash, err := tagCommit(repo, newestName)
+	if err != nil {
+		return plumbing.ZeroHash, "", fmt.Errorf("tag %s: %w", newestName.Short(), err)
+	}
+	return hash, newestName.Short(), nil
+}
+
+// semver is a tag such as v1.4.2 or 2.0.0-rc.1. Build metadata is ignored.
+type semver struct {
+	major, minor, patch int
+	pre                 string
+}
+
+func parseSemver(value string) (semver, bool) {
+	value = strings.TrimPrefix(value, "v")
+	value, _, _ = strings.Cut(value, "+")
+	value, pre, _ := strings.Cut(value, "-")
+
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return semver{}, false
+		}
+		numbers[i] = n
+	}
+	return semver{major: numbers[0], minor: numbers[1], patch: numbers[2], pre: pre}, true
+}
+
+// compare orders versions, a pre-release before its release.
+func (v semver) compare(other semver) int {
+	for _, d := range []int{v.major - other.major, v.minor - other.minor, v.patch - other.patch} {
+		if d != 0 {
+			return d
+		}
+	}
+	switch {
+	case v.pre == other.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case other.pre == "":
+		return -1
+	}
+	return strings.Compare(v.pre, other.pre)
+}
+
+// versionRange is a set of comparisons a version must all pass.
+type versionRange struct {
+	raw         string
+	comparators []versionComparator
+	// prerelease lets pre-release tags match, only when the range itself
+	// names one.
+	prerelease bool
+}
+
+type versionComparator struct {
+	op      string
+	version semver
+}
+
+func (r versionRange) String() string {
+	return r.raw
+}
+
+// parseVersionRange reads space separated comparisons such as ">=1.2.0 <2",
+// wildcards such as v1.* or 1.2.x, and ^1.2 or ~1.2.3 shorthands.
+func parseVersionRange(value string) (versionRange, error) {
+	r := versionRange{raw: value, prerelease: strings.Contains(value, "-")}
+	for _, field := range strings.Fields(value) {
+		comparators, err := parseComparator(field)
+		if err != nil {
+			return versionRange{}, err
+		}
+		r.comparators = append(r.comparators, comparators...)
+	}
+	if len(r.comparators) == 0 {
+		return versionRange{}, errors.New("empty range")
+	}
+	return r, nil
+}
+
+func parseComparator(field string) ([]versionComparator, error) {
+	op := field[:len(field)-len(strings.TrimLeft(field, "<>=^~"))]
+	version := strings.TrimPrefix(field[len(op):], "v")
+
+	// Missing or wildcard parts widen the range to everything under the
+	// parts that are given.
+	version, pre, _ := strings.Cut(version, "-")
+	var numbers []int
+	for i, part := range strings.Split(version, ".") {
+		if part == "*" || part == "x" || part == "X" {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || i > 2 {
+			return nil, fmt.Errorf("invalid version %q", field)
+		}
+		numbers = append(numbers, n)
+	}
+
+	lower := semver{pre: pre}
+	for i, target := range []*int{&lower.major, &lower.minor, &lower.patch} {
+		if i < len(numbers) {
+			*target = numbers[i]
+		}
+	}
+	// upper is the first version past a partial version, 1.2 giving 1.3.0.
+	upper := func(depth int) semver {
+		switch {
+		case depth <= 0:
+			return semver{major: 1 << 30}
+		case depth == 1:
+			return semver{major: lower.major + 1}
+		default:
+			return semver{major: lower.major, minor: lower.minor + 1}
+		}
+	}
+
+	switch op {
+	case "", "=":
+		if len(numbers) == 3 {
+			return []versionComparator{{"=", lower}}, nil
+		}
+		return []versionComparator{{">=", lower}, {"<", upper(len(numbers))}}, nil
+	case "^":
+		depth := 1
+		if lower.major == 0 {
+			depth = 2
+		}
+		return []versionComparator{{">=", lower}, {"<", upper(min(depth, max(len(numbers), 1)))}}, nil
+	case "~":
+		return []versionComparator{{">=", lower}, {"<", upper(min(len(numbers), 2))}}, nil
+	case ">", ">=", "<", "<=":
+		if op == ">" && len(numbers) < 3 {
+			return []versionComparator{{">=", upper(len(numbers))}}, nil
+		}
+		if op == "<=" && len(numbers) < 3 {
+			return []versionComparator{{"<", upper(len(numbers))}}, nil
+		}
+		return []versionComparator{{op, lower}}, nil
+	}
+	return nil, fmt.Errorf("invalid operator in %q", field)
+}
+
+func (r versionRange) matches(v semver) bool {
+	if v.pre != "" && !r.prerelease {
+		return false
+	}
+	for _, c := range r.comparators {
+		d := v.compare(c.version)
+		var ok bool
+		switch c.op {
+		case "=":
+			ok = d == 0
+		case ">":
+			ok = d > 0
+		case ">=":
+			ok = d >= 0
+		case "<":
+			ok = d < 0
+		case "<=":
+			ok = d <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRefPolicy(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  string
+		pinned    bool
+		expectErr bool
+	}{
+		{value: "", expected: "branch"},
+		{value: "branch", expected: "branch"},
+		{value: "tag:v1.4.2", expected: "tag:v1.4.2", pinned: true},
+		{value: "semver:>=1.2.0 <2.0.0", expected: "semver:>=1.2.0 <2.0.0", pinned: true},
+		{value: "commit:3f2a9c1", expected: "commit:3f2a9c1", pinned: true},
+		{value: "tag:", expectErr: true},
+		{value: "commit:main", expectErr: true},
+		{value: "semver:one", expectErr: true},
+		{value: "release:v1", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			policy, err := parseRefPolicy(tc.value)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, policy.String())
+			assert.Equal(t, tc.pinned, policy.pinned())
+		})
+	}
+}
+
+func TestVersionRangeMatches(t *testing.T) {
+	tests := []struct {
+		versions string
+		match    []string
+		noMatch  []string
+	}{
+		{versions: "v1.*", match: []string{"v1.0.0", "1.9.3"}, noMatch: []string{"v2.0.0", "v0.9.9", "v1.2.0-rc.1"}},
+		{versions: "1.2.x", match: []string{"1.2.0", "1.2.7"}, noMatch: []string{"1.3.0", "1.1.9"}},
+		{versions: "^1.2", match: []string{"1.2.0", "1.9.0"}, noMatch: []string{"2.0.0", "1.1.0"}},
+		{versions: "^0.3.1", match: []string{"0.3.1", "0.3.9"}, noMatch: []string{"0.4.0"}},
+		{versions: "~1.2.3", match: []string{"1.2.3", "1.2.9"}, noMatch: []string{"1.3.0", "1.2.2"}},
+		{versions: ">=1.2.0 <2.0.0", match: []string{"1.2.0", "1.99.0"}, noMatch: []string{"2.0.0", "1.1.0"}},
+		{versions: ">1.2", match: []string{"1.3.0"}, noMatch: []string{"1.2.5"}},
+		{versions: ">=2.0.0-rc.1", match: []string{"2.0.0-rc.2", "2.0.0"}, noMatch: []string{"2.0.0-beta"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.versions, func(t *testing.T) {
+			versions, err := parseVersionRange(tc.versions)
+			require.NoError(t, err)
+			for _, value := range tc.match {
+				v, ok := parseSemver(value)
+				require.True(t, ok, value)
+				assert.True(t, versions.matches(v), value)
+			}
+			for _, value := range tc.noMatch {
+				v, ok := parseSemver(value)
+				require.True(t, ok, value)
+				assert.False(t, versions.matches(v), value)
+			}
+		})
+	}
+}
+
+func TestResolveRef(t *testing.T) {
+	repo, err := git.PlainInit(t.TempDir(), false)
+	require.NoError(t, err)
+
+	first := commitFile(t, repo, "a", &git.CommitOptions{})
+	_, err = repo.CreateTag("v1.0.0", first, nil)
+	require.NoError(t, err)
+
+	second := commitFile(t, repo, "b", &git.CommitOptions{})
+	_, err = repo.CreateTag("v1.1.0", second, &git.CreateTagOptions{
+		Message: "release",
+		Tagger:  &object.Signature{Name: "dev", Email: "dev@example.com", When: time.Now()},
+	})
+	require.NoError(t, err)
+
+	third := commitFile(t, repo, "c", &git.CommitOptions{})
+	_, err = repo.CreateTag("v2.0.0", third, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		ref       string
+		expected  string
+		name      string
+		expectErr bool
+	}{
+		{ref: "tag:v1.0.0", expected: first.String(), name: "v1.0.0"},
+		{ref: "tag:v1.1.0", expected: second.String(), name: "v1.1.0"},
+		{ref: "semver:^1", expected: second.String(), name: "v1.1.0"},
+		{ref: "semver:*", expected: third.String(), name: "v2.0.0"},
+		{ref: "commit:" + first.String()[:7], expected: first.String(), name: shortHash(first.String())},
+		{ref: "tag:v3.0.0", expectErr: true},
+		{ref: "semver:^3", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.ref, func(t *testing.T) {
+			policy, err := parseRefPolicy(tc.ref)
+			require.NoError(t, err)
+
+			hash, name, err := resolveRef(repo, policy)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, hash.String())
+			assert.Equal(t, tc.name, name)
+		})
+	}
+}
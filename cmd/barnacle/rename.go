@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var projectNameInvalidChars = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// composeProjectName is the project name docker compose derives from a stack
+// directory by default. It stands in for the name compose reports when that
+// was never recorded, such as for stacks deployed by an older barnacle.
+func composeProjectName(stackName string) string {
+	// Nested stacks are named by their path, prod/web becoming prod-web.
+	name := strings.ReplaceAll(strings.ToLower(stackName), "/", "-")
+	name = projectNameInvalidChars.ReplaceAllString(name, "")
+	return strings.TrimLeft(name, "_-")
+}
+
+// detectRenames pairs new stacks with deleted ones they were renamed from,
+// either because git saw the directory move or because both carry the same
+// id in their manifest. It returns new stack names mapped to old ones.
+func detectRenames(stacksPath string, state *State, currentStacks map[string]bool, deletedStacks []string, gitRenames map[string]string) map[string]string {
+	renames := make(map[string]string)
+	if len(deletedStacks) == 0 {
+		return renames
+	}
+
+	deleted := make(map[string]bool, len(deletedStacks))
+	deletedByID := make(map[string]string)
+	for _, stackName := range deletedStacks {
+		deleted[stackName] = true
+		if id := state.stackID(stackName); id != "" {
+			deletedByID[id] = stackName
+		}
+	}
+
+	claimed := make(map[string]bool)
+	for _, newName := range sortedKeys(currentStacks) {
+		if state.DeployedStacks[newName] {
+			continue
+		}
+
+		oldName := gitRenames[newName]
+		if manifest, err := loadStackManifest(filepath.Join(stacksPath, newName)); err == nil && manifest.ID != "" {
+			if byID, ok := deletedByID[manifest.ID]; ok {
+				oldName = byID
+			}
+		}
+		if oldName == "" || !deleted[oldName] || claimed[oldName] {
+			continue
+		}
+
+		claimed[oldName] = true
+		renames[newName] = oldName
+	}
+	return renames
+}
+
+// applyRenames moves renamed stacks over to their new name in the inventory,
+// keeping the compose project so the containers are updated in place instead
+// of a second project coming up next to the old one. It returns the deleted
+// stacks that were not renamed.
+func applyRenames(state *State, renames map[string]string, deletedStacks []string) []string {
+	remaining := []string{}
+	renamedFrom := make(map[string]bool, len(renames))
+	for newName, oldName := range renames {
+		slog.Info("Stack renamed", "stack", newName, "from", oldName, "project", state.stackProject(oldName))
+		state.renameStack(oldName, newName)
+		renamedFrom[oldName] = true
+	}
+
+	for _, stackName := range deletedStacks {
+		if !renamedFrom[stackName] {
+			remaining = append(remaining, stackName)
+		}
+	}
+	return remaining
+}
+
+// moveProject takes down the compose project a deployed stack ran as before
+// its manifest moved it to another one, so the old containers don't hold on
+// to ports and names the new project needs.
+func moveProject(ctx context.Context, config Config, stackName, previous string, project composeProject) error {
+	slog.Info("Stack moved to another compose project, taking down the old one", "stack", stackName, "from", previous, "project", project.name)
+	old := newComposeProject(config, stackName, "", previous, stackManifest{})
+	if err := dockerComposeDown(ctx, old, false); err != nil {
+		return fmt.Errorf("failed to take down previous project %s: %w", previous, err)
+	}
+	return nil
+}
+
+// reportRenames folds the deploy result of each renamed stack into a single
+// "new (renamed from old)" result.
+func reportRenames(results map[string]error, renames map[string]string) {
+	for newName, oldName := range renames {
+		if err, ok := results[newName]; ok {
+			delete(results, newName)
+			results[newName+resultRenamedFrom+oldName+")"] = err
+		}
+	}
+}
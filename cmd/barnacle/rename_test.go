@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComposeProjectName(t *testing.T) {
+	assert.Equal(t, "whoami", composeProjectName("whoami"))
+	assert.Equal(t, "myapp-v2", composeProjectName("MyApp-v2"))
+	assert.Equal(t, "webfrontend", composeProjectName("_web.frontend"))
+	assert.Equal(t, "prod-web", composeProjectName("prod/Web"))
+}
+
+func TestDetectRenames(t *testing.T) {
+	repoPath := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(repoPath, "db-v2"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "db-v2", manifestFileName), []byte("id: db\n"), 0644))
+
+	state := newState()
+	state.setDeployedStacks(map[string]bool{"whoami": true, "db": true, "cache": true})
+	state.recordManifest("db", stackManifest{ID: "db"})
+
+	currentStacks := map[string]bool{"whoami-v2": true, "db-v2": true, "new": true}
+	deletedStacks := []string{"cache", "db", "whoami"}
+	gitRenames := map[string]string{"whoami-v2": "whoami"}
+
+	renames := detectRenames(repoPath, state, currentStacks, deletedStacks, gitRenames)
+	assert.Equal(t, map[string]string{"whoami-v2": "whoami", "db-v2": "db"}, renames)
+
+	remaining := applyRenames(state, renames, deletedStacks)
+	assert.Equal(t, []string{"cache"}, remaining)
+	assert.Equal(t, map[string]bool{"whoami-v2": true, "db-v2": true, "cache": true}, state.DeployedStacks)
+	assert.Equal(t, "whoami", state.stackProject("whoami-v2"))
+	assert.Equal(t, "new", state.stackProject("new"))
+
+	results := map[string]error{"whoami-v2": nil, "db-v2": nil, "new": nil}
+	reportRenames(results, renames)
+	assert.Equal(t, map[string]error{
+		"whoami-v2 (renamed from whoami)": nil,
+		"db-v2 (renamed from db)":         nil,
+		"new":                             nil,
+	}, results)
+
+	state.recordDeployment("abc123", results)
+	status, ok := state.stackStatus("whoami-v2")
+	require.True(t, ok)
+	assert.Equal(t, stackStatusDeployed, status.Status)
+	_, ok = state.stackStatus("whoami")
+	assert.False(t, ok)
+}
+
+// TestProjectChangeTakesDownOldProject swaps docker for a script that logs
+// its arguments.
+func TestProjectChangeTakesDownOldProject(t *testing.T) {
+	binDir := t.TempDir()
+	log := filepath.Join(binDir, "log")
+	script := "#!/bin/sh\necho \"$*\" >> " + log + "\n" +
+		"case \"$*\" in *--services*) echo web ;; *config) echo 'name: web' ;; esac\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "docker"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config := Config{RepoPath: t.TempDir()}
+	stackPath := filepath.Join(config.RepoPath, "web")
+	require.NoError(t, os.MkdirAll(stackPath, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(stackPath, "compose.yml"), []byte("services: {}\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(stackPath, manifestFileName), []byte("project: shop\n"), 0644))
+
+	state := newState()
+	state.setDeployedStacks(map[string]bool{"web": true})
+	state.recordManifest("web", stackManifest{Project: "legacy"})
+
+	readLog := func() []string {
+		data, err := os.ReadFile(log)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(log))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	results := make(map[string]error)
+	deployStacks(context.Background(), config, map[string]bool{"web": true}, stackLabels{}, state, results)
+	require.NoError(t, results["web"])
+	calls := readLog()
+	assert.Equal(t, "compose -p legacy down --remove-orphans", calls[0])
+	assert.Contains(t, calls[len(calls)-1], "compose -p shop ")
+	assert.Equal(t, "shop", state.stackProject("web"))
+
+	// Dropping project: hands the name back to compose.
+	require.NoError(t, os.Remove(filepath.Join(stackPath, manifestFileName)))
+	deployStacks(context.Background(), config, map[string]bool{"web": true}, stackLabels{}, state, results)
+	require.NoError(t, results["web"])
+	calls = readLog()
+	assert.Contains(t, calls, "compose -p shop down --remove-orphans")
+	assert.Equal(t, "", state.pinnedProject("web"))
+	assert.Equal(t, "web", state.stackProject("web"))
+}
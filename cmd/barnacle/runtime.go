@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	runtimeAuto          = "auto"
+	runtimeDocker        = "docker"
+	runtimePodman        = "podman"
+	runtimePodmanCompose = "podman-compose"
+)
+
+// Labels compose puts on every container it creates.
+const (
+	labelComposeProject       = "com.docker.compose.project"
+	labelComposeService       = "com.docker.compose.service"
+	labelPodmanComposeProject = "io.podman.compose.project"
+)
+
+// containerRuntime is the container CLI barnacle drives stacks with, and
+// where its compose implementation differs from Docker's.
+type containerRuntime struct {
+	name string
+	// binary runs container commands such as ps and rm.
+	binary string
+	// composeBinary and composeCommand run compose: docker compose, podman
+	// compose or podman-compose.
+	composeBinary  string
+	composeCommand string
+	// removeOrphans is whether compose up and down take --remove-orphans.
+	// Without it barnacle removes leftover containers itself, and takes
+	// down stacks whose directory is gone by their project label.
+	removeOrphans bool
+	projectLabel  string
+	// labelFormat is the ps --format template for one label's value.
+	labelFormat string
+}
+
+var (
+	dockerRuntime = containerRuntime{
+		name:           runtimeDocker,
+		binary:         "docker",
+		composeBinary:  "docker",
+		composeCommand: "compose",
+		removeOrphans:  true,
+		projectLabel:   labelComposeProject,
+		labelFormat:    `{{.Label "%s"}}`,
+	}
+	podmanRuntime = containerRuntime{
+		name:           runtimePodman,
+		binary:         "podman",
+		composeBinary:  "podman",
+		composeCommand: "compose",
+		// podman compose hands over to docker-compose or podman-compose,
+		// and the latter does not take --remove-orphans everywhere.
+		projectLabel: labelComposeProject,
+		labelFormat:  `{{index .Labels "%s"}}`,
+	}
+	podmanComposeRuntime = containerRuntime{
+		name:          runtimePodmanCompose,
+		binary:        "podman",
+		composeBinary: "podman-compose",
+		projectLabel:  labelPodmanComposeProject,
+		labelFormat:   `{{index .Labels "%s"}}`,
+	}
+)
+
+// parseRuntime reads CONTAINER_RUNTIME: docker, podman (podman compose),
+// podman-compose, or auto to pick one from the binaries and sockets present.
+func parseRuntime(value string) (containerRuntime, error) {
+	switch value {
+	case runtimeAuto, "":
+		return detectRuntime(exec.LookPath, fileExists), nil
+	case runtimeDocker:
+		return dockerRuntime, nil
+	case runtimePodman:
+		return podmanRuntime, nil
+	case runtimePodmanCompose:
+		return podmanComposeRuntime, nil
+	}
+	return containerRuntime{}, fmt.Errorf("invalid CONTAINER_RUNTIME %q: want auto, docker, podman or podman-compose", value)
+}
+
+// detectRuntime prefers Docker, unless only podman is installed or only a
+// Podman socket is there to talk to, as on rootless Podman hosts where docker
+// may be a shim around podman.
+func detectRuntime(lookPath func(string) (string, error), exists func(string) bool) containerRuntime {
+	installed := func(name string) bool {
+		_, err := lookPath(name)
+		return err == nil
+	}
+
+	dockerSocket := os.Getenv("DOCKER_HOST") != "" || exists("/var/run/docker.sock")
+	podmanSocket := os.Getenv("CONTAINER_HOST") != "" || exists("/run/podman/podman.sock")
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && exists(filepath.Join(dir, "podman", "podman.sock")) {
+		podmanSocket = true
+	}
+
+	if !installed("podman") || (installed("docker") && (dockerSocket || !podmanSocket)) {
+		return dockerRuntime
+	}
+	if installed("podman-compose") {
+		return podmanComposeRuntime
+	}
+	return podmanRuntime
+}
+
+// runtime returns the configured runtime, Docker if there is none.
+func (c Config) runtime() containerRuntime {
+	return cmp.Or(c.Runtime, dockerRuntime)
+}
+
+// command builds a runtime invocation that is asked to stop with SIGTERM,
+// rather than killed, when ctx is cancelled.
+func (rt containerRuntime) command(ctx context.Context, args ...string) *exec.Cmd {
+	return interruptibleCommand(ctx, rt.binary, args...)
+}
+
+func (rt containerRuntime) compose(ctx context.Context, args ...string) *exec.Cmd {
+	if rt.composeCommand != "" {
+		args = append([]string{rt.composeCommand}, args...)
+	}
+	return interruptibleCommand(ctx, rt.composeBinary, args...)
+}
+
+func interruptibleCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
+}
+
+// removeProjectContainers removes the project's containers, other than those
+// of the services to keep, by the compose project label. It stands in for
+// --remove-orphans, and for down once the compose files are gone, on runtimes
+// that need it.
+func removeProjectContainers(ctx context.Context, project composeProject, keepServices []string, removeVolumes bool) error {
+	rt := project.runtime
+	filter := "label=" + rt.projectLabel + "=" + project.name
+
+	var stdout, stderr bytes.Buffer
+	cmd := rt.command(ctx, "ps", "-a", "--filter", filter, "--format", "{{.ID}} "+fmt.Sprintf(rt.labelFormat, labelComposeService))
+	cmd.Env = project.target.env()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s ps failed: %w: %s", rt.binary, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var orphans []string
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		id, service, _ := strings.Cut(line, " ")
+		if id != "" && !slices.Contains(keepServices, service) {
+			orphans = append(orphans, id)
+		}
+	}
+	if len(orphans) > 0 {
+		slog.Info("Removing containers no longer in the stack", "stack", project.stack, "containers", len(orphans))
+		if err := runQuiet(ctx, project, append([]string{"rm", "-f"}, orphans...)...); err != nil {
+			return err
+		}
+	}
+
+	if removeVolumes {
+		stdout.Reset()
+		cmd := rt.command(ctx, "volume", "ls", "-q", "--filter", filter)
+		cmd.Env = project.target.env()
+		cmd.Stdout = &stdout
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s volume ls failed: %w", rt.binary, err)
+		}
+		if volumes := strings.Fields(stdout.String()); len(volumes) > 0 {
+			return runQuiet(ctx, project, append([]string{"volume", "rm", "-f"}, volumes...)...)
+		}
+	}
+	return nil
+}
+
+func runQuiet(ctx context.Context, project composeProject, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := project.runtime.command(ctx, args...)
+	cmd.Env = project.target.env()
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", project.runtime.binary, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
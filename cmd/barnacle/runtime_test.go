@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectRuntime(t *testing.T) {
+	tests := []struct {
+		name     string
+		binaries []string
+		sockets  []string
+		expected containerRuntime
+	}{
+		{name: "nothing installed", expected: dockerRuntime},
+		{name: "docker", binaries: []string{"docker"}, sockets: []string{"/var/run/docker.sock"}, expected: dockerRuntime},
+		{name: "both with docker socket", binaries: []string{"docker", "podman"}, sockets: []string{"/var/run/docker.sock", "/run/podman/podman.sock"}, expected: dockerRuntime},
+		{name: "docker shim on podman", binaries: []string{"docker", "podman"}, sockets: []string{"/run/podman/podman.sock"}, expected: podmanRuntime},
+		{name: "rootless podman", binaries: []string{"podman"}, sockets: []string{"/run/user/1000/podman/podman.sock"}, expected: podmanRuntime},
+		{name: "podman-compose", binaries: []string{"podman", "podman-compose"}, expected: podmanComposeRuntime},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("DOCKER_HOST", "")
+			t.Setenv("CONTAINER_HOST", "")
+			t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+
+			lookPath := func(name string) (string, error) {
+				if slices.Contains(tc.binaries, name) {
+					return "/usr/bin/" + name, nil
+				}
+				return "", errors.New("not found")
+			}
+			exists := func(path string) bool { return slices.Contains(tc.sockets, path) }
+			assert.Equal(t, tc.expected, detectRuntime(lookPath, exists))
+		})
+	}
+}
+
+func TestParseRuntime(t *testing.T) {
+	rt, err := parseRuntime("podman-compose")
+	require.NoError(t, err)
+	assert.Equal(t, podmanComposeRuntime, rt)
+
+	_, err = parseRuntime("containerd")
+	assert.Error(t, err)
+}
+
+// TestPodmanComposeRemovesOrphans swaps podman and podman-compose for scripts
+// that log their arguments, with an old service's container left running.
+func TestPodmanComposeRemovesOrphans(t *testing.T) {
+	binDir := t.TempDir()
+	log := filepath.Join(binDir, "log")
+	podman := "#!/bin/sh\necho \"podman $*\" >> " + log + "\n" +
+		"if [ \"$1\" = ps ]; then printf 'c1 web\\nc2 worker\\n'; fi\n"
+	podmanCompose := "#!/bin/sh\necho \"podman-compose $*\" >> " + log + "\n" +
+		"case \"$*\" in *config*) echo web ;; esac\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "podman"), []byte(podman), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "podman-compose"), []byte(podmanCompose), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	stackPath := filepath.Join(binDir, "web")
+	require.NoError(t, os.MkdirAll(stackPath, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(stackPath, "compose.yml"), []byte("services: {}\n"), 0644))
+
+	config := Config{Runtime: podmanComposeRuntime}
+	readLog := func() []string {
+		data, err := os.ReadFile(log)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(log))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	project := newComposeProject(config, "web", stackPath, "web", stackManifest{})
+	require.NoError(t, dockerComposeUp(context.Background(), project, map[string]string{labelStack: "web"}))
+	calls := readLog()
+	require.Len(t, calls, 5)
+	assert.Contains(t, calls[1], "up -d")
+	assert.NotContains(t, calls[1], "--remove-orphans")
+	assert.Equal(t, `podman ps -a --filter label=io.podman.compose.project=web --format {{.ID}} {{index .Labels "com.docker.compose.service"}}`, calls[3])
+	assert.Equal(t, "podman rm -f c2", calls[4])
+
+	gone := newComposeProject(config, "web", filepath.Join(binDir, "missing"), "web", stackManifest{})
+	require.NoError(t, dockerComposeDown(context.Background(), gone, true))
+	calls = readLog()
+	require.Len(t, calls, 3)
+	assert.Equal(t, "podman rm -f c1 c2", calls[1])
+	assert.Equal(t, "podman volume ls -q --filter label=io.podman.compose.project=web", calls[2])
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// shutdownTimeout bounds how long an in-flight git or compose command may keep
+// running once shutdown has been requested. It is set from SHUTDOWN_TIMEOUT.
+var shutdownTimeout = 2 * time.Minute
+
+// commandContext returns a context for a single external operation. Cancelling
+// ctx stops barnacle from starting new work, but the operation already running
+// is given shutdownTimeout to finish before it is cancelled too.
+func commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	cmdCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	timeout := shutdownTimeout
+
+	stop := context.AfterFunc(ctx, func() {
+		timer := time.AfterFunc(timeout, cancel)
+		context.AfterFunc(cmdCtx, func() { timer.Stop() })
+	})
+
+	return cmdCtx, func() {
+		stop()
+		cancel()
+	}
+}
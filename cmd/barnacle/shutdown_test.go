@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandContextOutlivesShutdown(t *testing.T) {
+	defer func(timeout time.Duration) { shutdownTimeout = timeout }(shutdownTimeout)
+	shutdownTimeout = 50 * time.Millisecond
+
+	ctx, stop := context.WithCancel(context.Background())
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	stop()
+	assert.NoError(t, cmdCtx.Err(), "in-flight command should keep running after shutdown starts")
+
+	select {
+	case <-cmdCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("command context was not cancelled after the shutdown timeout")
+	}
+}
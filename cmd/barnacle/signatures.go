@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	verifySignaturesOff  = "off"
+	verifySignaturesHead = "head"
+	verifySignaturesAll  = "all"
+)
+
+// maxVerifiedCommits bounds how far back an all-commits check walks, so a
+// push that joins unrelated history is refused rather than walked in full.
+const maxVerifiedCommits = 1000
+
+var (
+	errUnsigned        = errors.New("commit is not signed")
+	errUntrustedSigner = errors.New("signature is not from a trusted key")
+)
+
+// untrustedCommitError is returned when a commit fails signature
+// verification. Nothing from it has been deployed.
+type untrustedCommitError struct {
+	commit string
+	err    error
+}
+
+func (e *untrustedCommitError) Error() string {
+	return fmt.Sprintf("commit %s refused: %v", shortHash(e.commit), e.err)
+}
+
+func (e *untrustedCommitError) Unwrap() error {
+	return e.err
+}
+
+func parseVerifySignatures(value string) (string, error) {
+	switch value {
+	case verifySignaturesOff, verifySignaturesHead, verifySignaturesAll:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid VERIFY_SIGNATURES %q: want off, head or all", value)
+}
+
+// verifyCommits checks the signature on newCommit, and with
+// VERIFY_SIGNATURES=all on every commit since oldCommit as well. The trusted
+// keys are read on each check so they can be rotated without a restart.
+func verifyCommits(repo *git.Repository, oldCommit, newCommit plumbing.Hash, config Config) error {
+	if config.VerifySignatures == verifySignaturesOff || config.VerifySignatures == "" {
+		return nil
+	}
+
+	keys, err := loadTrustedKeys(config)
+	if err != nil {
+		return err
+	}
+
+	// The new commit is always checked, including when a pin rolls back to
+	// an older commit and there is nothing in between.
+	commits := []plumbing.Hash{newCommit}
+	if config.VerifySignatures == verifySignaturesAll && !oldCommit.IsZero() {
+		between, err := commitsBetween(repo, oldCommit, newCommit)
+		if err != nil {
+			return &untrustedCommitError{commit: newCommit.String(), err: err}
+		}
+		for _, hash := range between {
+			if hash != newCommit {
+				commits = append(commits, hash)
+			}
+		}
+	}
+
+	for _, hash := range commits {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return fmt.Errorf("failed to read commit %s: %w", shortHash(hash.String()), err)
+		}
+		if _, err := keys.verify(commit); err != nil {
+			return &untrustedCommitError{commit: hash.String(), err: err}
+		}
+	}
+	return nil
+}
+
+// commitsBetween lists the commits reachable from newCommit but not from
+// oldCommit, merged branches included. Commits missing from a shallow clone
+// are behind its boundary, and so not new.
+func commitsBetween(repo *git.Repository, oldCommit, newCommit plumbing.Hash) ([]plumbing.Hash, error) {
+	var commits []plumbing.Hash
+	seen := map[plumbing.Hash]bool{newCommit: true}
+	queue := []plumbing.Hash{newCommit}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+
+		if hash == oldCommit {
+			continue
+		}
+		commit, err := repo.CommitObject(hash)
+		if errors.Is(err, plumbing.ErrObjectNotFound) && hash != newCommit {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %s: %w", shortHash(hash.String()), err)
+		}
+		if ancestor, err := isAncestor(repo, hash, oldCommit); err != nil {
+			return nil, err
+		} else if ancestor {
+			continue
+		}
+
+		commits = append(commits, hash)
+		if len(commits) > maxVerifiedCommits {
+			return nil, fmt.Errorf("more than %d new commits to verify", maxVerifiedCommits)
+		}
+		for _, parent := range commit.ParentHashes {
+			if !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return commits, nil
+}
+
+// trustedKeys are the keys commits may be signed with: an armored OpenPGP
+// keyring and the SSH keys from an allowed signers file.
+type trustedKeys struct {
+	pgpKeyring string
+	sshSigners []allowedSigner
+}
+
+type allowedSigner struct {
+	principal string
+	key       ssh.PublicKey
+}
+
+func loadTrustedKeys(config Config) (trustedKeys, error) {
+	var keys trustedKeys
+	if config.GPGKeyring != "" {
+		data, err := os.ReadFile(config.GPGKeyring)
+		if err != nil {
+			return keys, fmt.Errorf("failed to read GPG_KEYRING: %w", err)
+		}
+		keys.pgpKeyring = string(data)
+	}
+	if config.SSHAllowedSigners != "" {
+		data, err := os.ReadFile(config.SSHAllowedSigners)
+		if err != nil {
+			return keys, fmt.Errorf("failed to read SSH_ALLOWED_SIGNERS: %w", err)
+		}
+		if keys.sshSigners, err = parseAllowedSigners(data); err != nil {
+			return keys, fmt.Errorf("SSH_ALLOWED_SIGNERS: %w", err)
+		}
+	}
+	return keys, nil
+}
+
+// parseAllowedSigners reads git's gpg.ssh.allowedSignersFile format:
+// "principals [options] keytype key [comment]" per line. Options are not
+// interpreted.
+func parseAllowedSigners(data []byte) ([]allowedSigner, error) {
+	var signers []allowedSigner
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		var key ssh.PublicKey
+		for i := 1; i < len(fields) && key == nil; i++ {
+			key, _, _, _, _ = ssh.ParseAuthorizedKey([]byte(strings.Join(fields[i:], " ")))
+		}
+		if key == nil {
+			return nil, fmt.Errorf("line %d: no public key found", n+1)
+		}
+		signers = append(signers, allowedSigner{principal: fields[0], key: key})
+	}
+	return signers, nil
+}
+
+// verify checks the commit's signature and returns who signed it.
+func (k trustedKeys) verify(commit *object.Commit) (string, error) {
+	signature := strings.TrimSpace(commit.PGPSignature)
+	switch {
+	case signature == "":
+		return "", errUnsigned
+	case strings.HasPrefix(signature, "-----BEGIN PGP SIGNATURE-----"):
+		if k.pgpKeyring == "" {
+			return "", fmt.Errorf("%w: GPG signature but no GPG_KEYRING", errUntrustedSigner)
+		}
+		entity, err := commit.Verify(k.pgpKeyring)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errUntrustedSigner, err)
+		}
+		for name := range entity.Identities {
+			return name, nil
+		}
+		return entity.PrimaryKey.KeyIdString(), nil
+	case strings.HasPrefix(signature, "-----BEGIN SSH SIGNATURE-----"):
+		encoded := &plumbing.MemoryObject{}
+		if err := commit.EncodeWithoutSignature(encoded); err != nil {
+			return "", err
+		}
+		reader, err := encoded.Reader()
+		if err != nil {
+			return "", err
+		}
+		var message bytes.Buffer
+		if _, err := message.ReadFrom(reader); err != nil {
+			return "", err
+		}
+		return verifySSHSignature(message.Bytes(), []byte(signature), k.sshSigners)
+	}
+	return "", fmt.Errorf("%w: unsupported signature format", errUntrustedSigner)
+}
+
+const sshSigMagic = "SSHSIG"
+
+// verifySSHSignature checks an armored signature made with ssh-keygen -Y sign
+// in the git namespace, as git writes for gpg.format=ssh.
+func verifySSHSignature(message, armored []byte, signers []allowedSigner) (string, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return "", fmt.Errorf("%w: malformed SSH signature", errUntrustedSigner)
+	}
+	blob, ok := bytes.CutPrefix(block.Bytes, []byte(sshSigMagic))
+	if !ok {
+		return "", fmt.Errorf("%w: malformed SSH signature", errUntrustedSigner)
+	}
+
+	var sig struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(blob, &sig); err != nil {
+		return "", fmt.Errorf("%w: malformed SSH signature: %v", errUntrustedSigner, err)
+	}
+	if sig.Version != 1 || sig.Namespace != "git" {
+		return "", fmt.Errorf("%w: SSH signature is not a version 1 git signature", errUntrustedSigner)
+	}
+
+	var hash []byte
+	switch sig.HashAlgorithm {
+	case "sha256":
+		sum := sha256.Sum256(message)
+		hash = sum[:]
+	case "sha512":
+		sum := sha512.Sum512(message)
+		hash = sum[:]
+	default:
+		return "", fmt.Errorf("%w: unsupported hash %q", errUntrustedSigner, sig.HashAlgorithm)
+	}
+
+	publicKey, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errUntrustedSigner, err)
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &signature); err != nil {
+		return "", fmt.Errorf("%w: malformed SSH signature: %v", errUntrustedSigner, err)
+	}
+
+	signed := append([]byte(sshSigMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, hash})...)
+
+	for _, signer := range signers {
+		if !bytes.Equal(signer.key.Marshal(), publicKey.Marshal()) {
+			continue
+		}
+		if err := publicKey.Verify(signed, &signature); err != nil {
+			return "", fmt.Errorf("%w: %v", errUntrustedSigner, err)
+		}
+		return signer.principal, nil
+	}
+	return "", fmt.Errorf("%w: %s key %s", errUntrustedSigner, publicKey.Type(), ssh.FingerprintSHA256(publicKey))
+}
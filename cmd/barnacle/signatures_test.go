@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshCommitSigner signs commits the way git does with gpg.format=ssh.
+type sshCommitSigner struct {
+	signer ssh.Signer
+}
+
+func (s sshCommitSigner) Sign(message io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(message)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha512.Sum512(data)
+
+	signed := append([]byte(sshSigMagic), ssh.Marshal(struct {
+		Namespace, Reserved, HashAlgorithm string
+		Hash                               []byte
+	}{"git", "", "sha512", hash[:]})...)
+	signature, err := s.signer.Sign(rand.Reader, signed)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := append([]byte(sshSigMagic), ssh.Marshal(struct {
+		Version                            uint32
+		PublicKey                          []byte
+		Namespace, Reserved, HashAlgorithm string
+		Signature                          []byte
+	}{1, s.signer.PublicKey().Marshal(), "git", "", "sha512", ssh.Marshal(signature)})...)
+	return pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob}), nil
+}
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer
+}
+
+func commitFile(t *testing.T, repo *git.Repository, name string, options *git.CommitOptions) plumbing.Hash {
+	w, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(w.Filesystem.Root(), name), []byte(name), 0644))
+	_, err = w.Add(name)
+	require.NoError(t, err)
+
+	options.Author = &object.Signature{Name: "dev", Email: "dev@example.com", When: time.Now()}
+	hash, err := w.Commit("add "+name, options)
+	require.NoError(t, err)
+	return hash
+}
+
+func TestVerifyCommitSignatures(t *testing.T) {
+	keyDir := t.TempDir()
+
+	trusted := newSSHSigner(t)
+	allowedSigners := "# deployers\ndev@example.com namespaces=\"git\" " + string(ssh.MarshalAuthorizedKey(trusted.PublicKey()))
+	require.NoError(t, os.WriteFile(filepath.Join(keyDir, "allowed_signers"), []byte(allowedSigners), 0644))
+
+	entity, err := openpgp.NewEntity("dev", "", "dev@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	require.NoError(t, err)
+	var keyring bytes.Buffer
+	armored, err := armor.Encode(&keyring, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(armored))
+	require.NoError(t, armored.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(keyDir, "trusted.asc"), keyring.Bytes(), 0644))
+
+	config := Config{
+		VerifySignatures:  verifySignaturesHead,
+		GPGKeyring:        filepath.Join(keyDir, "trusted.asc"),
+		SSHAllowedSigners: filepath.Join(keyDir, "allowed_signers"),
+	}
+
+	tests := []struct {
+		name      string
+		options   git.CommitOptions
+		expectErr error
+	}{
+		{name: "unsigned", expectErr: errUnsigned},
+		{name: "trusted ssh key", options: git.CommitOptions{Signer: sshCommitSigner{trusted}}},
+		{name: "untrusted ssh key", options: git.CommitOptions{Signer: sshCommitSigner{newSSHSigner(t)}}, expectErr: errUntrustedSigner},
+		{name: "trusted gpg key", options: git.CommitOptions{SignKey: entity}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			repo, err := git.PlainInit(t.TempDir(), false)
+			require.NoError(t, err)
+			hash := commitFile(t, repo, "compose.yml", &tc.options)
+
+			err = verifyCommits(repo, plumbing.ZeroHash, hash, config)
+			if tc.expectErr != nil {
+				assert.ErrorIs(t, err, tc.expectErr)
+				var untrusted *untrustedCommitError
+				assert.ErrorAs(t, err, &untrusted)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestVerifyCommitRange(t *testing.T) {
+	keyDir := t.TempDir()
+	signer := newSSHSigner(t)
+	require.NoError(t, os.WriteFile(filepath.Join(keyDir, "allowed_signers"), []byte("dev@example.com "+string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), 0644))
+
+	repo, err := git.PlainInit(t.TempDir(), false)
+	require.NoError(t, err)
+	base := commitFile(t, repo, "a", &git.CommitOptions{Signer: sshCommitSigner{signer}})
+	unsigned := commitFile(t, repo, "b", &git.CommitOptions{})
+	head := commitFile(t, repo, "c", &git.CommitOptions{Signer: sshCommitSigner{signer}})
+
+	config := Config{VerifySignatures: verifySignaturesHead, SSHAllowedSigners: filepath.Join(keyDir, "allowed_signers")}
+	assert.NoError(t, verifyCommits(repo, base, head, config))
+
+	config.VerifySignatures = verifySignaturesAll
+	err = verifyCommits(repo, base, head, config)
+	var untrusted *untrustedCommitError
+	require.ErrorAs(t, err, &untrusted)
+	assert.Equal(t, unsigned.String(), untrusted.commit)
+
+	config.VerifySignatures = verifySignaturesOff
+	assert.NoError(t, verifyCommits(repo, base, head, config))
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxHistory = 50
+
+const (
+	stackStatusDeployed  = "deployed"
+	stackStatusFailed    = "failed"
+	stackStatusRemoved   = "removed"
+	stackStatusKept      = "kept"
+	stackStatusOrphaned  = "orphaned"
+	stackStatusSuspended = "suspended"
+)
+
+// Result maps are keyed by stack name, with a suffix for anything other than
+// a deploy saying what happened to a stack that left the repo.
+const (
+	resultDeleted  = " (deleted)"
+	resultKept     = " (kept)"
+	resultOrphaned = " (orphaned)"
+	// A renamed stack's deploy is reported as "new (renamed from old)".
+	resultRenamedFrom = " (renamed from "
+)
+
+type State struct {
+	Version        int                     `json:"version"`
+	DeployedStacks map[string]bool         `json:"deployed_stacks"`
+	LastCommit     string                  `json:"last_commit"`
+	LastSync       time.Time               `json:"last_sync,omitzero"`
+	LastDeploy     time.Time               `json:"last_deploy,omitzero"`
+	LastError      string                  `json:"last_error,omitempty"`
+	Stacks         map[string]*StackStatus `json:"stacks,omitempty"`
+	History        []Deployment            `json:"history,omitempty"`
+	Pending        *PendingDeletion        `json:"pending_deletion,omitempty"`
+	// Degraded is set when the state file existed but could not be read. The
+	// deployed stack inventory is then unknown, so nothing may be torn down
+	// until an operator clears it, restarts included.
+	Degraded string `json:"degraded,omitempty"`
+	// DeployedCommit is the commit whose changes have all been deployed,
+	// which the next pull diffs from. It only moves on once a pass has gone
+	// through every stack without being interrupted.
+	DeployedCommit string `json:"deployed_commit,omitempty"`
+
+	mu   sync.RWMutex
+	path string
+}
+
+type StackStatus struct {
+	Name        string    `json:"name"`
+	Status      string    `json:"status"`
+	Commit      string    `json:"commit,omitempty"`
+	LastDeploy  time.Time `json:"last_deploy,omitzero"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+	OnDelete    string    `json:"on_delete,omitempty"`
+	ID          string    `json:"id,omitempty"`
+	// Project is the compose project the stack is pinned to, by its
+	// manifest or a rename. ComposeProject is the name compose gave it on
+	// its last deploy when nothing was pinned.
+	Project             string `json:"project,omitempty"`
+	ProjectFromManifest bool   `json:"project_from_manifest,omitempty"`
+	ComposeProject      string `json:"compose_project,omitempty"`
+	// ConfigDigest hashes the stack's resolved compose config as of its last
+	// deploy, and ConfigCommit is the commit that config was first deployed
+	// at. Containers are labelled with ConfigCommit.
+	ConfigDigest string `json:"config_digest,omitempty"`
+	ConfigCommit string `json:"config_commit,omitempty"`
+}
+
+type Deployment struct {
+	Time      time.Time         `json:"time"`
+	Commit    string            `json:"commit"`
+	Succeeded []string          `json:"succeeded,omitempty"`
+	Failed    map[string]string `json:"failed,omitempty"`
+}
+
+// stateMigrations upgrade a decoded state file one version at a time; entry i
+// migrates from version i to i+1.
+var stateMigrations = []func(*State){
+	// Version 0 files predate versioning and per-stack status. Seed a status
+	// for every deployed stack so the API reports them.
+	func(s *State) {
+		for stackName := range s.DeployedStacks {
+			if _, ok := s.Stacks[stackName]; !ok {
+				s.Stacks[stackName] = &StackStatus{Name: stackName, Status: stackStatusDeployed, Commit: s.LastCommit}
+			}
+		}
+	},
+	// Version 2 once moved the deploy history to the audit log. The history is
+	// kept in the state again, so version 1 files need no change, but the step
+	// stays so files already written at version 2 are not refused as too new.
+	func(s *State) {},
+}
+
+var currentStateVersion = len(stateMigrations)
+
+var errStateTooNew = errors.New("state file was written by a newer version of barnacle")
+
+func newState() *State {
+	return &State{
+		Version:        currentStateVersion,
+		DeployedStacks: make(map[string]bool),
+		Stacks:         make(map[string]*StackStatus),
+	}
+}
+
+// loadState reads the state file at path, falling back to the backup written
+// by the previous save. If neither can be read the returned state is empty and
+// marked degraded. Only a state file from a newer barnacle is a hard error,
+// since saving over it would silently downgrade it.
+func loadState(path string) (*State, error) {
+	state, err := readStateFile(path)
+	if err == nil {
+		state.path = path
+		return state, nil
+	}
+	if errors.Is(err, errStateTooNew) {
+		return nil, err
+	}
+
+	backupPath := path + ".bak"
+	if errors.Is(err, os.ErrNotExist) {
+		if _, statErr := os.Stat(backupPath); errors.Is(statErr, os.ErrNotExist) {
+			state := newState()
+			state.path = path
+			return state, nil
+		}
+	}
+
+	slog.Error("Failed to load state file, trying backup", "path", path, "error", err)
+
+	state, backupErr := readStateFile(backupPath)
+	if backupErr == nil {
+		slog.Warn("Recovered state from backup", "path", backupPath)
+		state.path = path
+		return state, nil
+	}
+	if errors.Is(backupErr, errStateTooNew) {
+		return nil, backupErr
+	}
+
+	slog.Error("Failed to load state backup, starting with empty state and refusing to remove stacks",
+		"path", backupPath, "error", backupErr)
+
+	state = newState()
+	state.path = path
+	state.Degraded = fmt.Sprintf("state could not be loaded: %v", err)
+	preserveCorruptState(path)
+	return state, nil
+}
+
+func readStateFile(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := newState()
+	state.Version = 0
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if state.Version > currentStateVersion {
+		return nil, fmt.Errorf("%w: %s has version %d, expected at most %d", errStateTooNew, path, state.Version, currentStateVersion)
+	}
+
+	if state.DeployedStacks == nil {
+		state.DeployedStacks = make(map[string]bool)
+	}
+	if state.Stacks == nil {
+		state.Stacks = make(map[string]*StackStatus)
+	}
+
+	for state.Version < currentStateVersion {
+		slog.Info("Migrating state file", "path", path, "from", state.Version, "to", state.Version+1)
+		stateMigrations[state.Version](state)
+		state.Version++
+	}
+
+	return state, nil
+}
+
+// preserveCorruptState moves an unreadable state file aside so the next save
+// doesn't destroy it.
+func preserveCorruptState(path string) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	corruptPath := fmt.Sprintf("%s.corrupt-%s", path, time.Now().Format("20060102T150405"))
+	if err := os.Rename(path, corruptPath); err != nil {
+		slog.Warn("Failed to preserve corrupt state file", "path", path, "error", err)
+		return
+	}
+	slog.Warn("Moved corrupt state file aside", "path", corruptPath)
+}
+
+// saveState writes the state atomically: a temp file in the same directory is
+// synced and renamed over the old file, which is first copied to a backup.
+func saveState(state *State) error {
+	state.mu.RLock()
+	data, err := json.MarshalIndent(state, "", "  ")
+	state.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	if previous, err := os.ReadFile(state.path); err == nil && json.Valid(previous) {
+		if err := writeFileAtomic(state.path+".bak", previous); err != nil {
+			return fmt.Errorf("failed to back up state file: %w", err)
+		}
+	}
+
+	if err := writeFileAtomic(state.path, data); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func saveStateOrWarn(state *State) {
+	if err := saveState(state); err != nil {
+		slog.Warn("Failed to save state", "path", state.path, "error", err)
+	}
+}
+
+func (s *State) setDeployedStacks(stacks map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DeployedStacks = stacks
+}
+
+func (s *State) recordSync(commit string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.LastError = err.Error()
+		return
+	}
+
+	s.LastSync = time.Now()
+	s.LastError = ""
+	if commit != "" {
+		s.LastCommit = commit
+	}
+}
+
+func (s *State) recordDeployedCommit(commit string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DeployedCommit = commit
+}
+
+func (s *State) deployedCommit() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.DeployedCommit
+}
+
+// parseResultKey splits a result key into the stack name and the status a
+// successful result leaves it in.
+func parseResultKey(key string) (string, string) {
+	if newName, _, ok := splitRenameKey(key); ok {
+		return newName, stackStatusDeployed
+	}
+	for suffix, status := range map[string]string{
+		resultDeleted:  stackStatusRemoved,
+		resultKept:     stackStatusKept,
+		resultOrphaned: stackStatusOrphaned,
+	} {
+		if stackName, ok := strings.CutSuffix(key, suffix); ok {
+			return stackName, status
+		}
+	}
+	return key, stackStatusDeployed
+}
+
+func splitRenameKey(key string) (string, string, bool) {
+	newName, rest, ok := strings.Cut(key, resultRenamedFrom)
+	if !ok {
+		return key, "", false
+	}
+	oldName, ok := strings.CutSuffix(rest, ")")
+	return newName, oldName, ok
+}
+
+// recordDeployment folds the results of a deploy pass into the per-stack
+// status and appends it to the bounded history. Results use the same keys as
+// deployStacks and cleanupDeletedStacks.
+func (s *State) recordDeployment(commit string, results map[string]error) {
+	if len(results) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	succeeded, failed := summarizeResults(results)
+	deployment := Deployment{
+		Time:      now,
+		Commit:    commit,
+		Succeeded: succeeded,
+		Failed:    failed,
+	}
+
+	for key, err := range results {
+		stackName, outcome := parseResultKey(key)
+
+		status := s.Stacks[stackName]
+		if status == nil {
+			status = &StackStatus{Name: stackName}
+			s.Stacks[stackName] = status
+		}
+		status.LastDeploy = now
+		status.Commit = commit
+
+		if err != nil {
+			status.Status = stackStatusFailed
+			status.LastError = err.Error()
+			continue
+		}
+
+		status.Status = outcome
+		status.LastSuccess = now
+		status.LastError = ""
+	}
+
+	s.LastDeploy = now
+	s.History = append(s.History, deployment)
+	if len(s.History) > maxHistory {
+		s.History = s.History[len(s.History)-maxHistory:]
+	}
+}
+
+func (s *State) stackStatuses() []StackStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stacks := make([]StackStatus, 0, len(s.Stacks))
+	for _, status := range s.Stacks {
+		stacks = append(stacks, *status)
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		return stacks[i].Name < stacks[j].Name
+	})
+	return stacks
+}
+
+func (s *State) stackStatus(name string) (StackStatus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status, ok := s.Stacks[name]
+	if !ok {
+		return StackStatus{}, false
+	}
+	return *status, true
+}
+
+// recentHistory returns up to limit deployments, newest first.
+func (s *State) recentHistory(limit int) []Deployment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if limit <= 0 || limit > len(s.History) {
+		limit = len(s.History)
+	}
+
+	history := make([]Deployment, 0, limit)
+	for i := len(s.History) - 1; i >= 0 && len(history) < limit; i-- {
+		history = append(history, s.History[i])
+	}
+	return history
+}
+
+func summarizeResults(results map[string]error) ([]string, map[string]string) {
+	succeeded := []string{}
+	failed := make(map[string]string)
+	for key, err := range results {
+		if err != nil {
+			failed[key] = err.Error()
+		} else {
+			succeeded = append(succeeded, key)
+		}
+	}
+	sort.Strings(succeeded)
+	return succeeded, failed
+}
+
+// recoverInventory replaces an empty inventory with stacks found running in
+// Docker. Removals stay refused while the state is degraded, since stacks
+// without running containers cannot be recovered this way.
+func (s *State) recoverInventory(stacks map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.DeployedStacks = stacks
+	for stackName := range stacks {
+		if _, ok := s.Stacks[stackName]; !ok {
+			s.Stacks[stackName] = &StackStatus{Name: stackName, Status: stackStatusDeployed}
+		}
+	}
+}
+
+func (s *State) markSuspended(stackName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.Stacks[stackName]
+	if status == nil {
+		status = &StackStatus{Name: stackName}
+		s.Stacks[stackName] = status
+	}
+	status.Status = stackStatusSuspended
+}
+
+// recordManifest remembers what a stack's manifest said at its last deploy,
+// since the manifest is gone by the time the stack is deleted or renamed.
+func (s *State) recordManifest(stackName string, manifest stackManifest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.Stacks[stackName]
+	if status == nil {
+		status = &StackStatus{Name: stackName}
+		s.Stacks[stackName] = status
+	}
+	status.OnDelete = manifest.deletePolicy()
+	status.ID = manifest.ID
+	if manifest.Project != "" {
+		status.Project = manifest.Project
+		status.ProjectFromManifest = true
+	} else if status.ProjectFromManifest {
+		status.Project = ""
+		status.ProjectFromManifest = false
+	}
+}
+
+func (s *State) recordComposeProject(stackName, project string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status := s.Stacks[stackName]; status != nil {
+		status.ComposeProject = project
+	}
+}
+
+// configCommit returns the commit to label the stack's containers with: the
+// one recorded for its config when digest still matches, or else commit.
+func (s *State) configCommit(stackName, digest, commit string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if status := s.Stacks[stackName]; status != nil && status.ConfigDigest == digest && status.ConfigCommit != "" {
+		return status.ConfigCommit
+	}
+	return commit
+}
+
+func (s *State) recordConfig(stackName, digest, commit string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status := s.Stacks[stackName]; status != nil {
+		status.ConfigDigest = digest
+		status.ConfigCommit = commit
+	}
+}
+
+func (s *State) stackID(stackName string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if status := s.Stacks[stackName]; status != nil {
+		return status.ID
+	}
+	return ""
+}
+
+// pinnedProject returns the compose project a stack must be deployed as, or
+// "" to let compose name it. Nested stacks are always pinned to a name from
+// their whole path, since compose would name prod/web and staging/web both
+// web.
+func (s *State) pinnedProject(stackName string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if status := s.Stacks[stackName]; status != nil && status.Project != "" {
+		return status.Project
+	}
+	if strings.Contains(stackName, "/") {
+		return composeProjectName(stackName)
+	}
+	return ""
+}
+
+// stackProject returns the compose project a stack is running as: the pinned
+// one, else the one compose named on the last deploy, else the name compose
+// derives from the directory.
+func (s *State) stackProject(stackName string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.runningProject(stackName)
+}
+
+func (s *State) runningProject(stackName string) string {
+	if status := s.Stacks[stackName]; status != nil {
+		return cmp.Or(status.Project, status.ComposeProject, composeProjectName(stackName))
+	}
+	return composeProjectName(stackName)
+}
+
+// renameStack moves a stack's inventory entry and status to its new name and
+// pins the compose project it was running as.
+func (s *State) renameStack(oldName, newName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	project := s.runningProject(oldName)
+	status := s.Stacks[oldName]
+	if status == nil {
+		status = &StackStatus{}
+	}
+	status.Project = project
+	status.Name = newName
+	s.Stacks[newName] = status
+	delete(s.Stacks, oldName)
+
+	delete(s.DeployedStacks, oldName)
+	s.DeployedStacks[newName] = true
+}
+
+func (s *State) deletePolicy(stackName string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if status := s.Stacks[stackName]; status != nil {
+		return status.OnDelete
+	}
+	return ""
+}
+
+func (s *State) cleanupBlocked() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Degraded
+}
+
+// clearDegraded lets removals go ahead again once an operator has checked the
+// inventory. It reports whether the state was degraded.
+func (s *State) clearDegraded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	degraded := s.Degraded != ""
+	s.Degraded = ""
+	return degraded
+}
+
+func (s *State) pendingDeletion() *PendingDeletion {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.Pending == nil {
+		return nil
+	}
+	pending := *s.Pending
+	pending.Stacks = slices.Clone(s.Pending.Stacks)
+	return &pending
+}
+
+func (s *State) pendingDeletionStacks() map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stacks := make(map[string]bool)
+	if s.Pending != nil {
+		for _, stackName := range s.Pending.Stacks {
+			stacks[stackName] = true
+		}
+	}
+	return stacks
+}
+
+// holdDeletion records stacks whose removal waits for confirmation. It reports
+// whether the held set changed, so the alert is only sent once per removal.
+func (s *State) holdDeletion(stacks []string, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Pending != nil && slices.Equal(s.Pending.Stacks, stacks) {
+		s.Pending.Reason = reason
+		return false
+	}
+
+	since := time.Now()
+	if s.Pending != nil {
+		since = s.Pending.Since
+	}
+	s.Pending = &PendingDeletion{Stacks: stacks, Since: since, Reason: reason}
+	return true
+}
+
+func (s *State) unholdDeletion(stackName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Pending == nil {
+		return
+	}
+	s.Pending.Stacks = slices.DeleteFunc(s.Pending.Stacks, func(name string) bool {
+		return name == stackName
+	})
+	if len(s.Pending.Stacks) == 0 {
+		s.Pending = nil
+	}
+}
+
+func (s *State) forgetStacks(stacks []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stackName := range stacks {
+		delete(s.DeployedStacks, stackName)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordDeployment(t *testing.T) {
+	state := newState()
+
+	state.recordDeployment("abc123", map[string]error{
+		"web":           nil,
+		"db":            errors.New("docker compose up failed"),
+		"old (deleted)": nil,
+	})
+
+	web, ok := state.stackStatus("web")
+	assert.True(t, ok)
+	assert.Equal(t, stackStatusDeployed, web.Status)
+	assert.Equal(t, "abc123", web.Commit)
+
+	db, _ := state.stackStatus("db")
+	assert.Equal(t, stackStatusFailed, db.Status)
+	assert.Equal(t, "docker compose up failed", db.LastError)
+
+	old, _ := state.stackStatus("old")
+	assert.Equal(t, stackStatusRemoved, old.Status)
+
+	history := state.recentHistory(0)
+	assert.Len(t, history, 1)
+	assert.Equal(t, []string{"old (deleted)", "web"}, history[0].Succeeded)
+	assert.Equal(t, map[string]string{"db": "docker compose up failed"}, history[0].Failed)
+}
+
+func TestRecentHistoryIsBounded(t *testing.T) {
+	state := newState()
+	for i := 0; i < maxHistory+5; i++ {
+		state.recordDeployment("abc123", map[string]error{"web": nil})
+	}
+
+	assert.Len(t, state.recentHistory(0), maxHistory)
+	assert.Len(t, state.recentHistory(3), 3)
+}
+
+func TestLoadStateMigratesUnversionedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"deployed_stacks":{"web":true},"last_commit":"abc123"}`), 0644))
+
+	state, err := loadState(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, currentStateVersion, state.Version)
+	assert.Empty(t, state.cleanupBlocked())
+	web, ok := state.stackStatus("web")
+	assert.True(t, ok)
+	assert.Equal(t, stackStatusDeployed, web.Status)
+}
+
+func TestSaveStateKeepsBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	state, err := loadState(path)
+	require.NoError(t, err)
+	state.setDeployedStacks(map[string]bool{"web": true})
+	require.NoError(t, saveState(state))
+
+	state.setDeployedStacks(map[string]bool{"web": true, "db": true})
+	require.NoError(t, saveState(state))
+
+	backup, err := readStateFile(path + ".bak")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"web": true}, backup.DeployedStacks)
+
+	current, err := readStateFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"web": true, "db": true}, current.DeployedStacks)
+}
+
+func TestLoadStateRecovery(t *testing.T) {
+	testCases := []struct {
+		name             string
+		primary          string
+		backup           string
+		expectedStacks   map[string]bool
+		expectedDegraded bool
+		expectedErr      error
+	}{
+		{
+			name:           "Missing state starts fresh",
+			expectedStacks: map[string]bool{},
+		},
+		{
+			name:           "Corrupt state falls back to backup",
+			primary:        `{"deployed_stacks":`,
+			backup:         `{"version":1,"deployed_stacks":{"web":true}}`,
+			expectedStacks: map[string]bool{"web": true},
+		},
+		{
+			name:           "Missing state with backup recovers backup",
+			backup:         `{"version":1,"deployed_stacks":{"web":true}}`,
+			expectedStacks: map[string]bool{"web": true},
+		},
+		{
+			name:             "Corrupt state and backup is degraded",
+			primary:          `{"deployed_stacks":`,
+			backup:           `not json`,
+			expectedStacks:   map[string]bool{},
+			expectedDegraded: true,
+		},
+		{
+			name:           "Version 2 state still loads",
+			primary:        `{"version":2,"deployed_stacks":{"web":true}}`,
+			expectedStacks: map[string]bool{"web": true},
+		},
+		{
+			name:        "Newer state version is refused",
+			primary:     `{"version":99,"deployed_stacks":{}}`,
+			expectedErr: errStateTooNew,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if tc.primary != "" {
+				require.NoError(t, os.WriteFile(path, []byte(tc.primary), 0644))
+			}
+			if tc.backup != "" {
+				require.NoError(t, os.WriteFile(path+".bak", []byte(tc.backup), 0644))
+			}
+
+			state, err := loadState(path)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStacks, state.DeployedStacks)
+			assert.Equal(t, tc.expectedDegraded, state.cleanupBlocked() != "")
+		})
+	}
+}
+
+func TestDegradedStateLastsUntilCleared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"deployed_stacks":`), 0644))
+
+	state, err := loadState(path)
+	require.NoError(t, err)
+	state.recoverInventory(map[string]bool{"web": true})
+	assert.NotEmpty(t, state.cleanupBlocked())
+	require.NoError(t, saveState(state))
+
+	state, err = loadState(path)
+	require.NoError(t, err)
+	assert.NotEmpty(t, state.cleanupBlocked(), "a restart must not clear the degraded state")
+	assert.Equal(t, map[string]bool{"web": true}, state.DeployedStacks)
+
+	assert.True(t, state.clearDegraded())
+	assert.False(t, state.clearDegraded())
+	require.NoError(t, saveState(state))
+
+	state, err = loadState(path)
+	require.NoError(t, err)
+	assert.Empty(t, state.cleanupBlocked())
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// localTargetName is how the Docker engine barnacle itself runs against is
+// shown in results and the API. Stacks without a target deploy there.
+const localTargetName = "local"
+
+var validTargetName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// dockerTarget is a Docker engine stacks are deployed to. The local target
+// has no name and uses whatever DOCKER_HOST or context barnacle was started
+// with; every other target is reached through its own host or context.
+type dockerTarget struct {
+	Name string
+	// Host is a DOCKER_HOST such as ssh://deploy@edge-1 or tcp://10.0.0.5:2376.
+	Host string
+	// Context names a docker context to use instead of a host.
+	Context string
+	// CertPath holds ca.pem, cert.pem and key.pem for a TLS tcp host.
+	CertPath string
+	// Identity is the SSH key Podman uses for an ssh host. Docker goes
+	// through the ssh client and its config instead.
+	Identity string
+}
+
+func (t dockerTarget) displayName() string {
+	if t.Name == "" {
+		return localTargetName
+	}
+	return t.Name
+}
+
+// env is the environment docker runs with for this target, or nil to inherit
+// barnacle's own.
+func (t dockerTarget) env() []string {
+	if t.Name == "" {
+		return nil
+	}
+
+	env := slices.DeleteFunc(os.Environ(), func(entry string) bool {
+		key, _, _ := strings.Cut(entry, "=")
+		switch key {
+		case "DOCKER_HOST", "DOCKER_CONTEXT", "DOCKER_TLS_VERIFY", "DOCKER_CERT_PATH", "CONTAINER_HOST", "CONTAINER_CONNECTION", "CONTAINER_SSHKEY":
+			return true
+		}
+		return false
+	})
+	// Podman reads CONTAINER_HOST and CONTAINER_CONNECTION instead, and
+	// Docker ignores them, so both are set.
+	if t.Context != "" {
+		return append(env, "DOCKER_CONTEXT="+t.Context, "CONTAINER_CONNECTION="+t.Context)
+	}
+	env = append(env, "DOCKER_HOST="+t.Host, "CONTAINER_HOST="+t.Host)
+	if t.Identity != "" {
+		env = append(env, "CONTAINER_SSHKEY="+t.Identity)
+	}
+	if t.CertPath != "" {
+		env = append(env, "DOCKER_TLS_VERIFY=1", "DOCKER_CERT_PATH="+t.CertPath)
+	}
+	return env
+}
+
+// statePath is where the target keeps its state, next to the local state
+// file: barnacle-state.json becomes barnacle-state.edge.json.
+func (t dockerTarget) statePath(localPath string) string {
+	if t.Name == "" {
+		return localPath
+	}
+	ext := filepath.Ext(localPath)
+	return strings.TrimSuffix(localPath, ext) + "." + t.Name + ext
+}
+
+// parseDockerTargets reads DOCKER_TARGETS, a comma separated list such as
+// "edge=ssh://deploy@edge-1,nas=tcp://10.0.0.5:2376,lab=context:lab". A tcp
+// target uses TLS with the certificates in certRoot's directory named after
+// it, and only the targets listed in insecure may do without. An ssh target's
+// directory there may hold the identity file Podman connects with.
+func parseDockerTargets(value, certRoot, insecure string) ([]dockerTarget, error) {
+	insecureTargets := make(map[string]bool)
+	for _, name := range strings.Split(insecure, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			insecureTargets[name] = true
+		}
+	}
+
+	var targets []dockerTarget
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, endpoint, ok := strings.Cut(entry, "=")
+		name, endpoint = strings.TrimSpace(name), strings.TrimSpace(endpoint)
+		if !ok || endpoint == "" {
+			return nil, fmt.Errorf("invalid DOCKER_TARGETS entry %q: want name=ssh://host, name=tcp://host:port or name=context:name", entry)
+		}
+		if !validTargetName.MatchString(name) || name == localTargetName {
+			return nil, fmt.Errorf("invalid DOCKER_TARGETS name %q: use lowercase letters, digits, dashes and underscores, other than %q", name, localTargetName)
+		}
+		if slices.ContainsFunc(targets, func(t dockerTarget) bool { return t.Name == name }) {
+			return nil, fmt.Errorf("duplicate DOCKER_TARGETS name %q", name)
+		}
+
+		target := dockerTarget{Name: name}
+		if context, ok := strings.CutPrefix(endpoint, "context:"); ok {
+			target.Context = context
+		} else {
+			scheme, _, _ := strings.Cut(endpoint, "://")
+			switch scheme {
+			case "ssh":
+				if identity := filepath.Join(certRoot, name, "identity"); certRoot != "" && fileExists(identity) {
+					target.Identity = identity
+				}
+			case "unix":
+			case "tcp":
+				switch {
+				case certRoot != "" && fileExists(filepath.Join(certRoot, name)):
+					target.CertPath = filepath.Join(certRoot, name)
+				case !insecureTargets[name]:
+					return nil, fmt.Errorf("DOCKER_TARGETS %s has no TLS certificates in %s; add them or list it in DOCKER_TARGETS_INSECURE to use plain TCP", name, filepath.Join(certRoot, name))
+				}
+			default:
+				return nil, fmt.Errorf("invalid DOCKER_TARGETS host %q for %s: want ssh://, tcp:// or unix://", endpoint, name)
+			}
+			target.Host = endpoint
+		}
+		targets = append(targets, target)
+	}
+
+	for name := range insecureTargets {
+		if !slices.ContainsFunc(targets, func(t dockerTarget) bool { return t.Name == name }) {
+			return nil, fmt.Errorf("DOCKER_TARGETS_INSECURE names %q, which is not in DOCKER_TARGETS", name)
+		}
+	}
+	return targets, nil
+}
+
+// checkTargetRuntime refuses targets the runtime cannot reach. Podman talks to
+// remote hosts over ssh or plain tcp only, so it has no use for TLS
+// certificates.
+func checkTargetRuntime(rt containerRuntime, targets []dockerTarget) error {
+	if rt.binary != "podman" {
+		return nil
+	}
+	for _, target := range targets {
+		if target.CertPath != "" {
+			return fmt.Errorf("DOCKER_TARGETS %s needs TLS, which %s cannot use; reach it over ssh:// or a podman connection with context:", target.Name, rt.name)
+		}
+	}
+	return nil
+}
+
+// forTarget returns the config a deploy to target runs with.
+func (c Config) forTarget(target dockerTarget) Config {
+	c.Target = target
+	return c
+}
+
+func (c Config) hasTarget(name string) bool {
+	return slices.ContainsFunc(c.Targets, func(t dockerTarget) bool { return t.Name == name })
+}
+
+// targetResultKey prefixes a result with the target it came from, so results
+// from several targets can be shown together.
+func targetResultKey(target dockerTarget, key string) string {
+	if target.Name == "" {
+		return key
+	}
+	return target.Name + ":" + key
+}
+
+// deployTarget is a Docker engine together with the inventory of what
+// barnacle deployed to it.
+type deployTarget struct {
+	docker dockerTarget
+	state  *State
+}
+
+// TargetStatus is a target as reported by the API.
+type TargetStatus struct {
+	Name       string    `json:"name"`
+	Host       string    `json:"host,omitempty"`
+	Context    string    `json:"context,omitempty"`
+	LastDeploy time.Time `json:"last_deploy,omitzero"`
+	LastError  string    `json:"last_error,omitempty"`
+	Stacks     int       `json:"stacks"`
+	Degraded   string    `json:"state_degraded,omitempty"`
+
+	PendingDeletion *PendingDeletion `json:"pending_deletion,omitempty"`
+}
+
+func (t *deployTarget) status() TargetStatus {
+	t.state.mu.RLock()
+	status := TargetStatus{
+		Name:       t.docker.displayName(),
+		Host:       t.docker.Host,
+		Context:    t.docker.Context,
+		LastDeploy: t.state.LastDeploy,
+		LastError:  t.state.LastError,
+		Stacks:     len(t.state.DeployedStacks),
+		Degraded:   t.state.Degraded,
+	}
+	t.state.mu.RUnlock()
+	status.PendingDeletion = t.state.pendingDeletion()
+	return status
+}
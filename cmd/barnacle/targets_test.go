@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDockerTargets(t *testing.T) {
+	certRoot := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(certRoot, "nas"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(certRoot, "edge"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(certRoot, "edge", "identity"), nil, 0600))
+
+	tests := []struct {
+		name      string
+		value     string
+		insecure  string
+		expected  []dockerTarget
+		expectErr bool
+	}{
+		{name: "empty", value: ""},
+		{
+			name:     "hosts and contexts",
+			value:    "edge=ssh://deploy@edge-1, nas=tcp://10.0.0.5:2376,lab=context:lab,plain=tcp://10.0.0.6:2375",
+			insecure: "plain",
+			expected: []dockerTarget{
+				{Name: "edge", Host: "ssh://deploy@edge-1", Identity: filepath.Join(certRoot, "edge", "identity")},
+				{Name: "nas", Host: "tcp://10.0.0.5:2376", CertPath: filepath.Join(certRoot, "nas")},
+				{Name: "lab", Context: "lab"},
+				{Name: "plain", Host: "tcp://10.0.0.6:2375"},
+			},
+		},
+		{name: "tcp without certificates", value: "plain=tcp://10.0.0.6:2375", expectErr: true},
+		{name: "unknown insecure target", value: "edge=ssh://edge-1", insecure: "plain", expectErr: true},
+		{name: "missing host", value: "edge", expectErr: true},
+		{name: "unknown scheme", value: "edge=http://edge-1", expectErr: true},
+		{name: "reserved name", value: "local=ssh://edge-1", expectErr: true},
+		{name: "invalid name", value: "Edge=ssh://edge-1", expectErr: true},
+		{name: "duplicate", value: "edge=ssh://a,edge=ssh://b", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			targets, err := parseDockerTargets(tc.value, certRoot, tc.insecure)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, targets)
+		})
+	}
+}
+
+func TestPodmanRefusesTLSTargets(t *testing.T) {
+	ssh := dockerTarget{Name: "edge", Host: "ssh://deploy@edge-1"}
+	tls := dockerTarget{Name: "nas", Host: "tcp://nas:2376", CertPath: "/certs/nas"}
+
+	assert.NoError(t, checkTargetRuntime(dockerRuntime, []dockerTarget{ssh, tls}))
+	assert.NoError(t, checkTargetRuntime(podmanRuntime, []dockerTarget{ssh}))
+	assert.Error(t, checkTargetRuntime(podmanRuntime, []dockerTarget{ssh, tls}))
+	assert.Error(t, checkTargetRuntime(podmanComposeRuntime, []dockerTarget{tls}))
+}
+
+func TestDockerTargetStatePath(t *testing.T) {
+	assert.Equal(t, "/app/barnacle-state.json", dockerTarget{}.statePath("/app/barnacle-state.json"))
+	assert.Equal(t, "/app/barnacle-state.edge.json", dockerTarget{Name: "edge"}.statePath("/app/barnacle-state.json"))
+}
+
+// TestComposeRunsAgainstTarget swaps docker and podman for scripts that
+// record the engine they were pointed at.
+func TestComposeRunsAgainstTarget(t *testing.T) {
+	binDir := t.TempDir()
+	record := filepath.Join(binDir, "record")
+	docker := "#!/bin/sh\necho \"$DOCKER_HOST|$DOCKER_TLS_VERIFY|$DOCKER_CERT_PATH|$*\" > " + record + "\n"
+	podman := "#!/bin/sh\necho \"$CONTAINER_HOST|$CONTAINER_SSHKEY|$CONTAINER_CONNECTION|$*\" > " + record + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "docker"), []byte(docker), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "podman"), []byte(podman), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("DOCKER_HOST", "unix:///var/run/docker.sock")
+	t.Setenv("CONTAINER_HOST", "unix:///run/podman/podman.sock")
+
+	const podmanPs = `ps -a --filter label=com.docker.compose.project=web --format {{.ID}} {{index .Labels "com.docker.compose.service"}}`
+	tests := []struct {
+		name     string
+		runtime  containerRuntime
+		target   dockerTarget
+		expected string
+	}{
+		{name: "local", target: dockerTarget{}, expected: "unix:///var/run/docker.sock|||compose -p web down --remove-orphans\n"},
+		{name: "ssh", target: dockerTarget{Name: "edge", Host: "ssh://deploy@edge-1"}, expected: "ssh://deploy@edge-1|||compose -p web down --remove-orphans\n"},
+		{name: "tls", target: dockerTarget{Name: "nas", Host: "tcp://nas:2376", CertPath: "/certs/nas"}, expected: "tcp://nas:2376|1|/certs/nas|compose -p web down --remove-orphans\n"},
+		{name: "podman local", runtime: podmanRuntime, target: dockerTarget{}, expected: "unix:///run/podman/podman.sock|||" + podmanPs + "\n"},
+		{name: "podman ssh", runtime: podmanRuntime, target: dockerTarget{Name: "edge", Host: "ssh://deploy@edge-1", Identity: "/certs/edge/identity"}, expected: "ssh://deploy@edge-1|/certs/edge/identity||" + podmanPs + "\n"},
+		{name: "podman connection", runtime: podmanRuntime, target: dockerTarget{Name: "lab", Context: "lab"}, expected: "||lab|" + podmanPs + "\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{Runtime: tc.runtime}.forTarget(tc.target)
+			project := newComposeProject(config, "web", filepath.Join(binDir, "missing"), "web", stackManifest{})
+			require.NoError(t, dockerComposeDown(context.Background(), project, false))
+
+			data, err := os.ReadFile(record)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, string(data))
+		})
+	}
+}